@@ -0,0 +1,278 @@
+// Package config reads the xe-daemon configuration file, an INI file such as
+//
+//	[global]
+//	interval = 60        # seconds between updates
+//	timeout = 30         # seconds a collector may run, in any section
+//	log-level = info     # error, info or debug
+//	balloon = true       # report that ballooning is supported
+//
+//	[network]
+//	include = eth* ens*  # interfaces to report, default all VIFs
+//	exclude = eth9
+//
+//	[disk]
+//	exclude = xvdb*      # partitions not to report
+//
+//	[memory]
+//	interval = 120       # a multiple of the global interval
+//
+//	[misc]
+//	enabled = false
+//
+// The collector sections are os, misc, network, disk and memory.
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultPath = "/etc/xe-daemon.conf"
+
+type LogLevel int
+
+const (
+	LogError LogLevel = iota
+	LogInfo
+	LogDebug
+)
+
+var logLevelNames = map[string]LogLevel{
+	"error": LogError,
+	"info":  LogInfo,
+	"debug": LogDebug,
+}
+
+func (l LogLevel) String() string {
+	for name, level := range logLevelNames {
+		if level == l {
+			return name
+		}
+	}
+	return strconv.Itoa(int(l))
+}
+
+// CollectorNames lists the collector sections in the order xe-daemon runs
+// them.
+var CollectorNames = []string{"os", "misc", "network", "disk", "memory"}
+
+// defaultDivisors gives how many updates apart collectors run when no
+// interval is configured, every update if not listed.
+var defaultDivisors = map[string]int{
+	"memory": 2,
+}
+
+// collectorsWithFilters are the collectors taking include and exclude
+// patterns, matched against interface and partition names respectively.
+var collectorsWithFilters = map[string]bool{
+	"network": true,
+	"disk":    true,
+}
+
+type Collector struct {
+	Enabled bool
+	// Interval and Timeout in seconds, 0 for the defaults
+	Interval int
+	Timeout  int
+	Include  []string
+	Exclude  []string
+}
+
+type Config struct {
+	Interval   int
+	Timeout    int
+	LogLevel   LogLevel
+	Balloon    bool
+	Collectors map[string]*Collector
+}
+
+func Default() *Config {
+	c := &Config{
+		Interval:   60,
+		Timeout:    30,
+		LogLevel:   LogInfo,
+		Balloon:    true,
+		Collectors: make(map[string]*Collector),
+	}
+	for _, name := range CollectorNames {
+		c.Collectors[name] = &Collector{Enabled: true}
+	}
+	return c
+}
+
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %q", value)
+}
+
+func parseSeconds(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid number of seconds %q", value)
+	}
+	return n, nil
+}
+
+// parseList splits a list of patterns separated by spaces or commas.
+func parseList(value string) ([]string, error) {
+	patterns := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	for _, p := range patterns {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", p)
+		}
+	}
+	return patterns, nil
+}
+
+func (c *Config) set(section, key, value string) (err error) {
+	if section == "global" {
+		switch key {
+		case "interval":
+			c.Interval, err = parseSeconds(value)
+		case "timeout":
+			c.Timeout, err = parseSeconds(value)
+		case "log-level":
+			level, ok := logLevelNames[strings.ToLower(value)]
+			if !ok {
+				return fmt.Errorf("invalid log level %q", value)
+			}
+			c.LogLevel = level
+		case "balloon":
+			c.Balloon, err = parseBool(value)
+		default:
+			return fmt.Errorf("unknown key %q in section [%s]", key, section)
+		}
+		return err
+	}
+
+	collector, ok := c.Collectors[section]
+	if !ok {
+		return fmt.Errorf("unknown section [%s]", section)
+	}
+	switch {
+	case key == "enabled":
+		collector.Enabled, err = parseBool(value)
+	case key == "interval":
+		collector.Interval, err = parseSeconds(value)
+	case key == "timeout":
+		collector.Timeout, err = parseSeconds(value)
+	case key == "include" && collectorsWithFilters[section]:
+		collector.Include, err = parseList(value)
+	case key == "exclude" && collectorsWithFilters[section]:
+		collector.Exclude, err = parseList(value)
+	default:
+		return fmt.Errorf("unknown key %q in section [%s]", key, section)
+	}
+	return err
+}
+
+// Parse reads a configuration, starting from the defaults, and validates it.
+func Parse(r io.Reader) (*Config, error) {
+	c := Default()
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: invalid section header %q", lineno, line)
+			}
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			if _, ok := c.Collectors[section]; !ok && section != "global" {
+				return nil, fmt.Errorf("line %d: unknown section [%s]", lineno, section)
+			}
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineno)
+		}
+		if section == "" {
+			return nil, fmt.Errorf("line %d: key outside of a section", lineno)
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+		if err := c.set(section, key, value); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate checks the settings which depend on each other, needed again
+// after command line flags override the file.
+func (c *Config) Validate() error {
+	if c.Interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	for _, name := range CollectorNames {
+		collector := c.Collectors[name]
+		if collector.Interval%c.Interval != 0 {
+			return fmt.Errorf("[%s] interval %d is not a multiple of the global interval %d",
+				name, collector.Interval, c.Interval)
+		}
+	}
+	return nil
+}
+
+// Divisor returns how many updates apart the collector runs.
+func (c *Config) Divisor(name string) int {
+	if collector := c.Collectors[name]; collector != nil && collector.Interval != 0 {
+		return collector.Interval / c.Interval
+	}
+	if d, ok := defaultDivisors[name]; ok {
+		return d
+	}
+	return 1
+}
+
+// CollectorTimeout returns how long the collector may run.
+func (c *Config) CollectorTimeout(name string) time.Duration {
+	timeout := c.Timeout
+	if collector := c.Collectors[name]; collector != nil && collector.Timeout != 0 {
+		timeout = collector.Timeout
+	}
+	return time.Duration(timeout) * time.Second
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	c, err := Parse(strings.NewReader(`
+# comment
+[global]
+interval = 30
+log-level = debug
+balloon = no
+
+[network]
+include = eth*, ens*   ; trailing comment
+exclude = eth9
+
+[memory]
+interval = 90
+timeout = 5
+
+[Misc]
+enabled = false
+`))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if c.Interval != 30 || c.LogLevel != LogDebug || c.Balloon {
+		t.Errorf("global settings wrong: %+v", c)
+	}
+	if net := c.Collectors["network"]; !reflect.DeepEqual(net.Include, []string{"eth*", "ens*"}) ||
+		!reflect.DeepEqual(net.Exclude, []string{"eth9"}) {
+		t.Errorf("network filters wrong: %+v", net)
+	}
+	if c.Collectors["misc"].Enabled || !c.Collectors["os"].Enabled {
+		t.Errorf("enabled wrong")
+	}
+	if d := c.Divisor("memory"); d != 3 {
+		t.Errorf("memory divisor %d, expected 3", d)
+	}
+	if d := c.Divisor("disk"); d != 1 {
+		t.Errorf("disk divisor %d, expected 1", d)
+	}
+	if d := c.CollectorTimeout("memory"); d != 5*time.Second {
+		t.Errorf("memory timeout %v, expected 5s", d)
+	}
+	if d := c.CollectorTimeout("disk"); d != 30*time.Second {
+		t.Errorf("disk timeout %v, expected 30s", d)
+	}
+}
+
+func TestParseEmpty(t *testing.T) {
+	c, err := Parse(strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if !reflect.DeepEqual(c, Default()) {
+		t.Errorf("empty configuration %+v differs from the default", c)
+	}
+	if d := c.Divisor("memory"); d != 2 {
+		t.Errorf("default memory divisor %d, expected 2", d)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, input := range []string{
+		"interval = 10",
+		"[global",
+		"[nosuch]",
+		"[global]\nfoo = 1",
+		"[global]\ninterval = 0",
+		"[global]\ninterval = x",
+		"[disk]\ntimeout = -1",
+		"[global]\nlog-level = loud",
+		"[global]\nballoon = maybe",
+		"[memory]\ninclude = *",
+		"[disk]\nexclude = [",
+		"[disk]\nenabled",
+		"[global]\ninterval = 60\n[memory]\ninterval = 90",
+	} {
+		if _, err := Parse(strings.NewReader(input)); err == nil {
+			t.Errorf("Parse(%q) succeeded", input)
+		}
+	}
+}
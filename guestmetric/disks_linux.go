@@ -0,0 +1,121 @@
+package guestmetric
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// diskPartitions returns the partitions of a disk from sysfs, which names
+// them as xvda1 but also nvme0n1p1 or mmcblk0p1, in partition order.
+func diskPartitions(disk string) ([]string, error) {
+	paths, err := filepath.Glob(fmt.Sprintf("/sys/block/%s/*/partition", disk))
+	if err != nil {
+		return nil, err
+	}
+	numbers := make(map[string]int)
+	var parts []string
+	for _, path := range paths {
+		part := filepath.Base(filepath.Dir(path))
+		line, err := readSysfs(path)
+		if err != nil {
+			continue
+		}
+		numbers[part], _ = strconv.Atoi(line)
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool { return numbers[parts[i]] < numbers[parts[j]] })
+	return parts, nil
+}
+
+// diskIndex returns the index of a disk from the letters after its prefix,
+// 0 for "a" and 26 for "aa", or -1 if they are not all lowercase letters.
+func diskIndex(letters string) int {
+	if letters == "" {
+		return -1
+	}
+	n := 0
+	for _, c := range letters {
+		if c < 'a' || c > 'z' {
+			return -1
+		}
+		n = n*26 + int(c-'a') + 1
+	}
+	return n - 1
+}
+
+// vbdID returns the device/vbd id Xen gives a disk by its name, following
+// the numbering of xvd, and of the emulated sd and hd disks, in the Xen
+// virtual block device interface, or "" if it has none.
+func vbdID(disk string) string {
+	var id int
+	switch {
+	case strings.HasPrefix(disk, "xvd"):
+		n := diskIndex(disk[3:])
+		switch {
+		case n < 0:
+			return ""
+		case n < 16:
+			id = 202<<8 | n<<4
+		default:
+			id = 1<<28 | n<<8
+		}
+	case strings.HasPrefix(disk, "sd"):
+		n := diskIndex(disk[2:])
+		if n < 0 || n >= 16 {
+			return ""
+		}
+		id = 8<<8 | n<<4
+	case strings.HasPrefix(disk, "hd"):
+		n := diskIndex(disk[2:])
+		if n < 0 || n >= 4 {
+			return ""
+		}
+		id = []int{3 << 8, 3<<8 | 64, 22 << 8, 22<<8 | 64}[n]
+	default:
+		return ""
+	}
+	return strconv.Itoa(id)
+}
+
+// diskBackend returns the device/vbd id of a disk and the device backing it
+// in dom0, or "" for disks with no Xen backend such as NVMe or virtio ones.
+func (c *Collector) diskBackend(disk string) (vbd string, dev string, err error) {
+	if c.Client == nil {
+		return "", "", nil
+	}
+	// blkfront disks name their vbd, emulated ones are found by number
+	emulated := false
+	nodename, err := readSysfs(fmt.Sprintf("/sys/block/%s/device/nodename", disk))
+	if err != nil || nodename == "" {
+		id := vbdID(disk)
+		if id == "" {
+			return "", "", nil
+		}
+		nodename, emulated = "device/vbd/"+id, true
+	}
+	backend, err := c.Client.Read(fmt.Sprintf("%s/backend", nodename))
+	if err == nil {
+		dev, err = c.Client.Read(fmt.Sprintf("%s/dev", backend))
+	}
+	if err != nil {
+		if emulated {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	return filepath.Base(nodename), dev, nil
+}
+
+// devicePath returns the /dev path of a block device, the mapper name for
+// device-mapper devices.
+func devicePath(name string) string {
+	if strings.HasPrefix(name, "dm-") {
+		if dmName, err := readSysfs(fmt.Sprintf("/sys/block/%s/dm/name", name)); err == nil && dmName != "" {
+			return "/dev/mapper/" + dmName
+		}
+	}
+	return "/dev/" + name
+}
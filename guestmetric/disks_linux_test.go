@@ -0,0 +1,31 @@
+package guestmetric
+
+import (
+	"testing"
+)
+
+func TestVbdID(t *testing.T) {
+	for disk, id := range map[string]string{
+		"xvda":    "51712",
+		"xvdb":    "51728",
+		"xvdp":    "51952",
+		"xvdq":    "268439552",
+		"xvdaa":   "268442112",
+		"sda":     "2048",
+		"sdb":     "2064",
+		"hda":     "768",
+		"hdb":     "832",
+		"hdc":     "5632",
+		"hdd":     "5696",
+		"hde":     "",
+		"sdq":     "",
+		"nvme0n1": "",
+		"vda":     "",
+		"xvd":     "",
+		"xvdA":    "",
+	} {
+		if got := vbdID(disk); got != id {
+			t.Errorf("vbdID(%q) = %q, expected %q", disk, got, id)
+		}
+	}
+}
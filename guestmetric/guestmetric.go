@@ -1,8 +1,7 @@
 package guestmetric
 
 import (
-	"bytes"
-	"os/exec"
+	"path/filepath"
 )
 
 type GuestMetric map[string]string
@@ -17,18 +16,6 @@ type GuestMetricsCollector interface {
 	CollectMemory() (GuestMetric, error)
 }
 
-func runCmd(name string, args ...string) (output string, err error) {
-	cmd := exec.Command(name, args...)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err = cmd.Run()
-	if err != nil {
-		return "", err
-	}
-	output = out.String()
-	return output, nil
-}
-
 func prefixKeys(prefix string, m GuestMetric) GuestMetric {
 	m1 := make(GuestMetric, 0)
 	for k, v := range m {
@@ -36,3 +23,21 @@ func prefixKeys(prefix string, m GuestMetric) GuestMetric {
 	}
 	return m1
 }
+
+// nameSelected reports whether name matches one of the include patterns, or
+// there are none, and none of the exclude patterns.
+func nameSelected(name string, include, exclude []string) bool {
+	selected := len(include) == 0
+	for _, pattern := range include {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			selected = true
+			break
+		}
+	}
+	for _, pattern := range exclude {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return false
+		}
+	}
+	return selected
+}
@@ -2,21 +2,48 @@ package guestmetric
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"fmt"
 	xenstoreclient "github.com/xenserver/xe-guest-utilities/xenstoreclient"
+	"net"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
 type Collector struct {
 	Client xenstoreclient.XenStoreClient
 	Ballon bool
 	Debug  bool
+	// glob patterns selecting the interfaces and partitions reported
+	NetworkInclude []string
+	NetworkExclude []string
+	DiskInclude    []string
+	DiskExclude    []string
+	// keeps the indices of data/volumes across collections, nil to only
+	// keep those found in XenStore
+	Volumes *VolumeIndex
+
+	ctx context.Context
+}
+
+// WithContext returns a copy of the collector which stops collecting when
+// ctx is done.
+func (c *Collector) WithContext(ctx context.Context) *Collector {
+	c1 := *c
+	c1.ctx = ctx
+	return &c1
+}
+
+func (c *Collector) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
 }
 
 func (c *Collector) CollectOS() (GuestMetric, error) {
@@ -81,44 +108,32 @@ func (c *Collector) CollectMemory() (GuestMetric, error) {
 	return prefixKeys("data/", current), nil
 }
 
+// enumNetworkAddresses lists the addresses of iface, which the net package
+// reads with rtnetlink, in the order the kernel reports them.
 func enumNetworkAddresses(iface string) (GuestMetric, error) {
-	const (
-		IP_RE   string = `(\d{1,3}\.){3}\d{1,3}`
-		IPV6_RE string = `[\da-f:]+[\da-f]`
-	)
-
-	var (
-		IP_IPV4_ADDR_RE       = regexp.MustCompile(`inet\s*(` + IP_RE + `).*\se[a-zA-Z0-9]+[\s\n]`)
-		IP_IPV6_ADDR_RE       = regexp.MustCompile(`inet6\s*(` + IPV6_RE + `)`)
-		IFCONFIG_IPV4_ADDR_RE = regexp.MustCompile(`inet addr:\s*(` + IP_RE + `)`)
-		IFCONFIG_IPV6_ADDR_RE = regexp.MustCompile(`inet6 addr:\s*(` + IPV6_RE + `)`)
-	)
-
 	d := make(GuestMetric, 0)
 
-	var v4re, v6re *regexp.Regexp
-	var out string
-	var err error
-	if out, err = runCmd("ip", "addr", "show", iface); err == nil {
-		v4re = IP_IPV4_ADDR_RE
-		v6re = IP_IPV6_ADDR_RE
-	} else if out, err = runCmd("ifconfig", iface); err == nil {
-		v4re = IFCONFIG_IPV4_ADDR_RE
-		v6re = IFCONFIG_IPV6_ADDR_RE
-	} else {
-		return nil, fmt.Errorf("Cannot find ip/ifconfig command")
+	ifc, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifc.Addrs()
+	if err != nil {
+		return nil, err
 	}
 
-	m := v4re.FindAllStringSubmatch(out, -1)
-	if m != nil {
-		for i, parts := range m {
-			d[fmt.Sprintf("ipv4/%d", i)] = parts[1]
+	v4, v6 := 0, 0
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
 		}
-	}
-	m = v6re.FindAllStringSubmatch(out, -1)
-	if m != nil {
-		for i, parts := range m {
-			d[fmt.Sprintf("ipv6/%d", i)] = parts[1]
+		if ip := ipnet.IP.To4(); ip != nil {
+			d[fmt.Sprintf("ipv4/%d", v4)] = ip.String()
+			v4++
+		} else {
+			d[fmt.Sprintf("ipv6/%d", v6)] = ipnet.IP.String()
+			v6++
 		}
 	}
 
@@ -145,6 +160,9 @@ func getPlainVifId(path string) (string, error) {
 
 func (c *Collector) getSriovVifId(path string) (string, error) {
 	sriovDevicePath := "xenserver/device/net-sriov-vf"
+	if c.Client == nil {
+		return "", fmt.Errorf("No xenstore client to look up SR-IOV VIFs")
+	}
 	macAddress, err := readSysfs(path + "/address")
 	if err != nil {
 		return "", err
@@ -188,7 +206,11 @@ func (c *Collector) CollectNetworkAddr() (GuestMetric, error) {
 	current := make(GuestMetric, 0)
 
 	var paths []string
-	vifNamePrefixList := [...]string{"eth", "eno", "ens", "emp", "enx", "enX"}
+	vifNamePrefixList := []string{"eth", "eno", "ens", "emp", "enx", "enX"}
+	if len(c.NetworkInclude) != 0 {
+		// the include patterns replace the usual VIF names
+		vifNamePrefixList = []string{""}
+	}
 	for _, prefix := range vifNamePrefixList {
 		prefixPaths, err := filepath.Glob(fmt.Sprintf("/sys/class/net/%s*", prefix))
 		if err != nil {
@@ -198,11 +220,14 @@ func (c *Collector) CollectNetworkAddr() (GuestMetric, error) {
 	}
 	for _, path := range paths {
 		// a path is going to be like "/sys/class/net/eth0"
+		iface := filepath.Base(path)
+		if !nameSelected(iface, c.NetworkInclude, c.NetworkExclude) {
+			continue
+		}
 		prefix, vifId, err := c.getTargetXenstorePath(path)
 		if err != nil {
 			continue
 		}
-		iface := filepath.Base(path)
 		if addrs, err := enumNetworkAddresses(iface); err == nil {
 			for tag, addr := range addrs {
 				current[fmt.Sprintf("%s/%s/%s", prefix, vifId, tag)] = addr
@@ -223,6 +248,27 @@ func readSysfs(filename string) (string, error) {
 	return scanner.Text(), nil
 }
 
+// addMounts sets the mount points of the stack of block devices under
+// prefix, and the filesystem and free space of the first one found.
+func addMounts(i map[string]string, prefix string, stack []string, mounts []mountInfo) {
+	found := mountsOf(stack, mounts)
+	for n, m := range found {
+		i[fmt.Sprintf("%smount_points/%d", prefix, n)] = m.mountPoint
+	}
+	if len(found) > 0 {
+		i[prefix+"filesystem"] = found[0].fsType
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(found[0].mountPoint, &st); err == nil {
+			// block counts are in fragments, as df reads them
+			size := uint64(st.Frsize)
+			if size == 0 {
+				size = uint64(st.Bsize)
+			}
+			i[prefix+"free"] = strconv.FormatUint(st.Bavail*size, 10)
+		}
+	}
+}
+
 func (c *Collector) CollectDisk() (GuestMetric, error) {
 	pi := make(GuestMetric, 0)
 
@@ -239,95 +285,135 @@ func (c *Collector) CollectDisk() (GuestMetric, error) {
 	var sortedDisks sort.StringSlice = disks
 	sortedDisks.Sort()
 
-	part_idx := 0
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	type volume struct {
+		id   string
+		keys map[string]string
+	}
+	var volumes []volume
 	for _, disk := range sortedDisks[:] {
-		paths, err = filepath.Glob(fmt.Sprintf("/dev/%s?*", disk))
+		parts, err := diskPartitions(disk)
 		if err != nil {
 			return nil, err
 		}
-		for _, path := range paths {
-			p := filepath.Base(path)
-			line, err := readSysfs(fmt.Sprintf("/sys/block/%s/%s/size", disk, p))
+		// a filesystem, LVM or RAID may be on the whole disk
+		whole := len(parts) == 0
+		if whole {
+			parts = []string{disk}
+		}
+		vbd, real_dev, err := c.diskBackend(disk)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range parts {
+			path := "/dev/" + p
+			if !nameSelected(p, c.DiskInclude, c.DiskExclude) {
+				continue
+			}
+			if err := c.context().Err(); err != nil {
+				return nil, err
+			}
+			line, err := readSysfs(fmt.Sprintf("/sys/class/block/%s/size", p))
 			if err != nil {
 				return nil, err
 			}
+			// sysfs sizes are in 512 byte sectors whatever the block size
 			size, err := strconv.ParseInt(line, 10, 64)
 			if err != nil {
 				return nil, err
 			}
-			blocksize := 512
-			if bs, err := readSysfs(fmt.Sprintf("/sys/block/%s/queue/physical_block_size", disk)); err == nil {
-				if bs1, err := strconv.Atoi(bs); err == nil {
-					blocksize = bs1
-				}
+			stack := blockStack(p)
+			probe := probeDevice(path)
+			if whole && probe == nil && len(stack) == 1 && len(mountsOf(stack, mounts)) == 0 {
+				// an empty disk, or one such as a CD-ROM in a format not probed
+				continue
 			}
-			real_dev := ""
-			if c.Client != nil {
-				nodename, err := readSysfs(fmt.Sprintf("/sys/block/%s/device/nodename", disk))
-				if err == nil {
-					backend, err := c.Client.Read(fmt.Sprintf("%s/backend", nodename))
-					if err != nil {
-						return nil, err
-					}
-					real_dev, err = c.Client.Read(fmt.Sprintf("%s/dev", backend))
-					if err != nil {
-						return nil, err
-					}
-				}
+			i := map[string]string{
+				"extents/0": real_dev,
+				"name":      path,
+				"size":      strconv.FormatInt(size*512, 10),
 			}
-			name := path
-			blkid, err := runCmd("blkid", "-s", "UUID", path)
-			if err != nil {
-				// ignore blkid errors
-				blkid = ""
+			for n, holder := range stack[1:] {
+				i[fmt.Sprintf("stack/%d", n)] = devicePath(holder)
 			}
-			if strings.Contains(blkid, "=") {
-				parts := strings.SplitN(strings.TrimSpace(blkid), "=", 2)
-				name = fmt.Sprintf("%s(%s)", name, strings.Trim(parts[1], "\""))
+			if probe != nil {
+				if probe.uuid != "" {
+					i["name"] = fmt.Sprintf("%s(%s)", path, probe.uuid)
+					i["uuid"] = probe.uuid
+				}
+				if probe.label != "" {
+					i["label"] = probe.label
+				}
+				if probe.fsType != "" {
+					i["filesystem"] = probe.fsType
+				}
 			}
-			i := map[string]string{
-				"extents/0": real_dev,
-				"name":      name,
-				"size":      strconv.FormatInt(size*int64(blocksize), 10),
+			var pv *lvmPV
+			if probe != nil && probe.fsType == "LVM2_member" {
+				pv = readLVMPV(path, p, probe.uuid)
+			} else if probe == nil {
+				pv = lvmPVFromSysfs(p)
 			}
-			output, err := runCmd("pvs", "--noheadings", "--units", "b", "-o", "pv_free,pv_fmt", path)
-			if err == nil && output != "" {
-				//exclude the first blank element
-				parts := regexp.MustCompile(`\s+`).Split(output, -1)[1:]
-				i["free"] = strings.TrimSpace(parts[0])[:len(parts[0])-1]
-				i["filesystem"] = strings.TrimSpace(parts[1])
+			if pv != nil {
+				if pv.format != "" {
+					i["filesystem"] = pv.format
+				}
+				if pv.free >= 0 {
+					i["free"] = strconv.FormatInt(pv.free, 10)
+				}
 				i["mount_points/0"] = "[LVM]"
-			} else {
-				output, err = runCmd("mount")
-				if err == nil {
-					m := regexp.MustCompile(`(?m)^(\S+) on (\S+) type (\S+)`).FindAllStringSubmatch(output, -1)
-					if m != nil {
-						for _, parts := range m {
-							if parts[1] == path {
-								i["mount_points/0"] = parts[2]
-								i["filesystem"] = parts[3]
-								break
-							}
-						}
-					}
+				i["lvm/vg"] = pv.vg
+				if pv.size >= 0 {
+					i["lvm/size"] = strconv.FormatInt(pv.size, 10)
 				}
-				output, err = runCmd("df", path)
-				if err == nil {
-					scanner := bufio.NewScanner(bytes.NewReader([]byte(output)))
-					scanner.Scan()
-					scanner.Scan()
-					parts := regexp.MustCompile(`\s+`).Split(scanner.Text(), -1)
-					free, err := strconv.ParseInt(parts[3], 10, 64)
-					if err == nil {
-						i["free"] = strconv.FormatInt(free*1024, 10)
+				for n, lv := range pv.lvs {
+					prefix := fmt.Sprintf("lvm/lvs/%d/", n)
+					i[prefix+"name"] = lv.name
+					if lv.size >= 0 {
+						i[prefix+"size"] = strconv.FormatInt(lv.size, 10)
+					}
+					if lv.dm == "" {
+						continue
+					}
+					if lvProbe := probeDevice("/dev/" + lv.dm); lvProbe != nil && lvProbe.fsType != "" {
+						i[prefix+"filesystem"] = lvProbe.fsType
 					}
+					addMounts(i, prefix, blockStack(lv.dm), mounts)
 				}
+			} else {
+				// look through device-mapper (LUKS) and md devices
+				// stacked on the partition for where it is mounted
+				addMounts(i, "", stack, mounts)
 			}
-			for k, v := range i {
-				pi[fmt.Sprintf("data/volumes/%d/%s", part_idx, k)] = v
-			}
-			part_idx += 1
+			id := volumeID(vbd, p, probe)
+			i["id"] = id
+			volumes = append(volumes, volume{id, i})
+		}
+	}
+
+	index := c.Volumes
+	if index == nil {
+		index = NewVolumeIndex()
+	}
+	published := make(map[string]int)
+	if index.empty() && c.Client != nil {
+		published = publishedVolumes(c.Client)
+	}
+	ids := make([]string, len(volumes))
+	for n, v := range volumes {
+		ids[n] = v.id
+	}
+	indices := index.assign(ids, published)
+	for _, v := range volumes {
+		n := indices[v.id]
+		for k, value := range v.keys {
+			pi[fmt.Sprintf("data/volumes/%d/%s", n, k)] = value
 		}
+		pi[fmt.Sprintf("data/volume_ids/%s", v.id)] = strconv.Itoa(n)
 	}
 	return pi, nil
 }
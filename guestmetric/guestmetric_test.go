@@ -25,6 +25,16 @@ func TestCollector(t *testing.T) {
 	}
 }
 
+func TestSriovVifIdWithoutClient(t *testing.T) {
+	// without a xenstore client the lookup fails rather than dereferencing it
+	c := Collector{
+		Client: nil,
+	}
+	if vifId, err := c.getSriovVifId("/sys/class/net/lo"); vifId != "" || err == nil {
+		t.Errorf("getSriovVifId() = %q, %v, expected an error", vifId, err)
+	}
+}
+
 func doBenchmark(b *testing.B, f CollectFunc) {
 	b.Logf("doBenchmark 1000 for %#v", f)
 	for i := 0; i < 1000; i++ {
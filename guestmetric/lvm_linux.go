@@ -0,0 +1,489 @@
+package guestmetric
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	lvmSectorSize    = 512
+	lvmMdaHeaderSize = 512
+	lvmMdaMagic      = " LVM2 x[5A%r0N*>"
+)
+
+// lvmConfig is a section of the LVM2 text metadata format, whose values are
+// strings, int64s, []interface{} arrays or nested lvmConfig sections.
+type lvmConfig map[string]interface{}
+
+func (c lvmConfig) section(key string) lvmConfig {
+	s, _ := c[key].(lvmConfig)
+	return s
+}
+
+func (c lvmConfig) str(key string) string {
+	s, _ := c[key].(string)
+	return s
+}
+
+func (c lvmConfig) int(key string) int64 {
+	n, _ := c[key].(int64)
+	return n
+}
+
+func (c lvmConfig) array(key string) []interface{} {
+	a, _ := c[key].([]interface{})
+	return a
+}
+
+type lvmTokenizer struct {
+	s   string
+	pos int
+}
+
+// next returns the next token, strings with their quotes, or "" at the end.
+func (t *lvmTokenizer) next() (string, error) {
+	for t.pos < len(t.s) {
+		switch c := t.s[t.pos]; {
+		case c == '#':
+			for t.pos < len(t.s) && t.s[t.pos] != '\n' {
+				t.pos++
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == 0:
+			t.pos++
+		case strings.IndexByte("{}[]=,", c) >= 0:
+			t.pos++
+			return string(c), nil
+		case c == '"':
+			start := t.pos
+			for t.pos++; t.pos < len(t.s) && t.s[t.pos] != '"'; t.pos++ {
+				if t.s[t.pos] == '\\' {
+					t.pos++
+				}
+			}
+			if t.pos >= len(t.s) {
+				return "", fmt.Errorf("Unterminated string in LVM metadata")
+			}
+			t.pos++
+			return t.s[start:t.pos], nil
+		default:
+			start := t.pos
+			for t.pos < len(t.s) && strings.IndexByte("{}[]=,#\" \t\r\n", t.s[t.pos]) < 0 {
+				t.pos++
+			}
+			return t.s[start:t.pos], nil
+		}
+	}
+	return "", nil
+}
+
+func parseLVMValue(tok string) (interface{}, error) {
+	if strings.HasPrefix(tok, `"`) {
+		var b strings.Builder
+		for i := 1; i < len(tok)-1; i++ {
+			if tok[i] == '\\' {
+				i++
+			}
+			b.WriteByte(tok[i])
+		}
+		return b.String(), nil
+	}
+	if n, err := strconv.ParseInt(tok, 10, 64); err == nil {
+		return n, nil
+	}
+	if _, err := strconv.ParseFloat(tok, 64); err == nil {
+		return tok, nil
+	}
+	return nil, fmt.Errorf("Invalid value %q in LVM metadata", tok)
+}
+
+func parseLVMSection(t *lvmTokenizer, top bool) (lvmConfig, error) {
+	c := make(lvmConfig)
+	for {
+		key, err := t.next()
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "":
+			if !top {
+				return nil, fmt.Errorf("Unterminated section in LVM metadata")
+			}
+			return c, nil
+		case "}":
+			if top {
+				return nil, fmt.Errorf("Unexpected } in LVM metadata")
+			}
+			return c, nil
+		}
+		tok, err := t.next()
+		if err != nil {
+			return nil, err
+		}
+		switch tok {
+		case "{":
+			if c[key], err = parseLVMSection(t, false); err != nil {
+				return nil, err
+			}
+		case "=":
+			if tok, err = t.next(); err != nil {
+				return nil, err
+			}
+			if tok != "[" {
+				if c[key], err = parseLVMValue(tok); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			array := []interface{}{}
+			for {
+				if tok, err = t.next(); err != nil {
+					return nil, err
+				}
+				if tok == "]" {
+					break
+				}
+				if tok == "," {
+					continue
+				}
+				v, err := parseLVMValue(tok)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, v)
+			}
+			c[key] = array
+		default:
+			return nil, fmt.Errorf("Expected = or { after %q in LVM metadata", key)
+		}
+	}
+}
+
+// parseLVMConfig parses the text format LVM2 keeps its volume group metadata
+// in, such as
+//
+//	vg0 {
+//		extent_size = 8192
+//		physical_volumes {
+//			pv0 {
+//				id = "abcdef-ghij-klmn-opqr-stuv-wxyz-012345"
+//				pe_count = 2559
+//			}
+//		}
+//	}
+func parseLVMConfig(text string) (lvmConfig, error) {
+	return parseLVMSection(&lvmTokenizer{s: text}, true)
+}
+
+// readLVMMetadata reads the text metadata from the first metadata area of
+// an LVM2 physical volume.
+func readLVMMetadata(r io.ReaderAt) (string, error) {
+	buf := make([]byte, 4*lvmSectorSize)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return "", err
+	}
+	var label []byte
+	for sector := 0; sector < 4; sector++ {
+		l := buf[sector*lvmSectorSize : (sector+1)*lvmSectorSize]
+		if string(l[0:8]) == "LABELONE" && string(l[24:32]) == "LVM2 001" {
+			label = l
+			break
+		}
+	}
+	if label == nil {
+		return "", fmt.Errorf("No LVM2 label")
+	}
+	// the PV header follows the label header, with the UUID and size
+	// before the lists of data and then metadata areas, each ended by a
+	// zero entry
+	pvHeader := int(binary.LittleEndian.Uint32(label[20:24]))
+	if pvHeader < 32 || pvHeader+40 > len(label) {
+		return "", fmt.Errorf("Invalid LVM2 label")
+	}
+	locns := label[pvHeader+40:]
+	list := 0
+	var mdaOffset, mdaSize uint64
+	for i := 0; i+16 <= len(locns); i += 16 {
+		offset := binary.LittleEndian.Uint64(locns[i:])
+		if offset == 0 {
+			if list++; list == 2 {
+				break
+			}
+			continue
+		}
+		if list == 1 {
+			mdaOffset, mdaSize = offset, binary.LittleEndian.Uint64(locns[i+8:])
+			break
+		}
+	}
+	if mdaOffset == 0 {
+		return "", fmt.Errorf("No LVM2 metadata area")
+	}
+
+	header := make([]byte, lvmMdaHeaderSize)
+	if _, err := r.ReadAt(header, int64(mdaOffset)); err != nil {
+		return "", err
+	}
+	if string(header[4:20]) != lvmMdaMagic {
+		return "", fmt.Errorf("Invalid LVM2 metadata area header")
+	}
+	offset := binary.LittleEndian.Uint64(header[40:])
+	size := binary.LittleEndian.Uint64(header[48:])
+	if offset == 0 || size == 0 || offset >= mdaSize || size > mdaSize {
+		return "", fmt.Errorf("No LVM2 metadata")
+	}
+	text := make([]byte, size)
+	// the metadata is in a circular buffer after the header
+	first := size
+	if offset+size > mdaSize {
+		first = mdaSize - offset
+	}
+	if _, err := r.ReadAt(text[:first], int64(mdaOffset+offset)); err != nil {
+		return "", err
+	}
+	if first < size {
+		if _, err := r.ReadAt(text[first:], int64(mdaOffset+lvmMdaHeaderSize)); err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimRight(string(text), "\x00"), nil
+}
+
+type lvmLV struct {
+	name string
+	size int64  // bytes, or -1 if unknown
+	dm   string // block device name such as "dm-0", or "" if not active
+}
+
+type lvmPV struct {
+	vg     string
+	format string
+	size   int64 // bytes of the extents, or -1 if unknown
+	free   int64 // bytes, or -1 if unknown
+	lvs    []lvmLV
+}
+
+// lvmAreas returns the physical volumes, by their names in the metadata, or
+// logical volumes a segment is made of with the number of extents on each.
+// Thin volumes are made of their pool, and thin pools of their data and
+// metadata volumes, each counted with the extents of the segment.
+func lvmAreas(segment lvmConfig) map[string]int64 {
+	areas := make(map[string]int64)
+	for _, key := range []string{"thin_pool", "pool", "metadata"} {
+		if name := segment.str(key); name != "" {
+			areas[name] += segment.int("extent_count")
+		}
+	}
+	for _, key := range []string{"stripes", "mirrors", "raids"} {
+		list := segment.array(key)
+		if len(list) == 0 {
+			continue
+		}
+		count := int64(len(list))
+		if key == "stripes" {
+			// stripes list pairs of a PV and its starting extent
+			count /= 2
+		}
+		perArea := segment.int("extent_count")
+		if key == "stripes" && count > 0 {
+			perArea /= count
+		}
+		for _, v := range list {
+			if name, ok := v.(string); ok {
+				areas[name] += perArea
+			}
+		}
+	}
+	return areas
+}
+
+// lvmPVInfo works out the usage of the physical volume with uuid from the
+// metadata of its volume group.
+func lvmPVInfo(config lvmConfig, uuid string) (*lvmPV, error) {
+	var vgName string
+	var vg lvmConfig
+	for name, v := range config {
+		if s, ok := v.(lvmConfig); ok {
+			vgName, vg = name, s
+			break
+		}
+	}
+	if vg == nil {
+		return nil, fmt.Errorf("No volume group in LVM metadata")
+	}
+	pvName := ""
+	var pv lvmConfig
+	for name, v := range vg.section("physical_volumes") {
+		if s, ok := v.(lvmConfig); ok && s.str("id") == uuid {
+			pvName, pv = name, s
+		}
+	}
+	if pv == nil {
+		return nil, fmt.Errorf("Physical volume %s not in volume group %s", uuid, vgName)
+	}
+	extent := vg.int("extent_size") * lvmSectorSize
+
+	lvs := vg.section("logical_volumes")
+	// extents of each LV, and the PVs and LVs each LV is made of
+	sizes := make(map[string]int64)
+	parts := make(map[string]map[string]int64)
+	used := int64(0)
+	for name, v := range lvs {
+		lv, ok := v.(lvmConfig)
+		if !ok {
+			continue
+		}
+		parts[name] = make(map[string]int64)
+		for _, s := range lv {
+			segment, ok := s.(lvmConfig)
+			if !ok {
+				continue
+			}
+			sizes[name] += segment.int("extent_count")
+			for area, n := range lvmAreas(segment) {
+				parts[name][area] += n
+				if area == pvName {
+					used += n
+				}
+			}
+		}
+	}
+	var onPV func(name string, seen map[string]bool) bool
+	onPV = func(name string, seen map[string]bool) bool {
+		if seen[name] {
+			return false
+		}
+		seen[name] = true
+		for area := range parts[name] {
+			if area == pvName || onPV(area, seen) {
+				return true
+			}
+		}
+		return false
+	}
+
+	info := &lvmPV{
+		vg:     vgName,
+		format: vg.str("format"),
+		size:   pv.int("pe_count") * extent,
+		free:   (pv.int("pe_count") - used) * extent,
+	}
+	for name, v := range lvs {
+		lv, _ := v.(lvmConfig)
+		visible := false
+		for _, status := range lv.array("status") {
+			if status == "VISIBLE" {
+				visible = true
+			}
+		}
+		if !visible || !onPV(name, make(map[string]bool)) {
+			continue
+		}
+		info.lvs = append(info.lvs, lvmLV{
+			name: name,
+			size: sizes[name] * extent,
+			dm:   dmByUUID("LVM-" + strings.ReplaceAll(vg.str("id")+lv.str("id"), "-", "")),
+		})
+	}
+	sort.Slice(info.lvs, func(i, j int) bool { return info.lvs[i].name < info.lvs[j].name })
+	return info, nil
+}
+
+// dmByUUID returns the name of the active device-mapper device with uuid.
+func dmByUUID(uuid string) string {
+	paths, _ := filepath.Glob("/sys/block/dm-*/dm/uuid")
+	for _, path := range paths {
+		if u, err := readSysfs(path); err == nil && u == uuid {
+			return filepath.Base(filepath.Dir(filepath.Dir(path)))
+		}
+	}
+	return ""
+}
+
+// splitDMName splits a device-mapper name such as "my--vg-root" into the
+// volume group and logical volume names, whose hyphens are doubled.
+func splitDMName(name string) (string, string, bool) {
+	for i := 0; i < len(name); i++ {
+		if name[i] != '-' {
+			continue
+		}
+		if i+1 < len(name) && name[i+1] == '-' {
+			i++
+			continue
+		}
+		return strings.ReplaceAll(name[:i], "--", "-"), strings.ReplaceAll(name[i+1:], "--", "-"), true
+	}
+	return "", "", false
+}
+
+// lvmPVFromSysfs finds the active logical volumes on a physical volume from
+// the device-mapper devices holding it, for when its metadata cannot be read.
+// Thin volumes are found through the devices of their pool holding them.
+func lvmPVFromSysfs(name string) *lvmPV {
+	info := &lvmPV{format: "lvm2", size: -1, free: -1}
+	seen := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		holders, _ := filepath.Glob(fmt.Sprintf("/sys/class/block/%s/holders/dm-*", name))
+		for _, holder := range holders {
+			dm := filepath.Base(holder)
+			if seen[dm] {
+				continue
+			}
+			seen[dm] = true
+			uuid, err := readSysfs(fmt.Sprintf("/sys/block/%s/dm/uuid", dm))
+			if err != nil || !strings.HasPrefix(uuid, "LVM-") {
+				continue
+			}
+			visit(dm)
+			// layers such as the -tpool device of a thin pool have their
+			// uuid suffixed and are not logical volumes themselves
+			if strings.Contains(uuid[len("LVM-"):], "-") {
+				continue
+			}
+			dmName, err := readSysfs(fmt.Sprintf("/sys/block/%s/dm/name", dm))
+			if err != nil {
+				continue
+			}
+			vg, lv, ok := splitDMName(dmName)
+			if !ok {
+				continue
+			}
+			info.vg = vg
+			size := int64(-1)
+			if line, err := readSysfs(fmt.Sprintf("/sys/block/%s/size", dm)); err == nil {
+				if sectors, err := strconv.ParseInt(line, 10, 64); err == nil {
+					size = sectors * lvmSectorSize
+				}
+			}
+			info.lvs = append(info.lvs, lvmLV{name: lv, size: size, dm: dm})
+		}
+	}
+	visit(name)
+	if info.vg == "" {
+		return nil
+	}
+	sort.Slice(info.lvs, func(i, j int) bool { return info.lvs[i].name < info.lvs[j].name })
+	return info
+}
+
+// readLVMPV describes the physical volume at path, with block device name,
+// from its metadata or else the device-mapper devices on it.
+func readLVMPV(path, name, uuid string) *lvmPV {
+	if f, err := os.Open(path); err == nil {
+		defer f.Close()
+		if text, err := readLVMMetadata(f); err == nil {
+			if config, err := parseLVMConfig(text); err == nil {
+				if info, err := lvmPVInfo(config, uuid); err == nil {
+					return info
+				}
+			}
+		}
+	}
+	return lvmPVFromSysfs(name)
+}
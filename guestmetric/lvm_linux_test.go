@@ -0,0 +1,273 @@
+package guestmetric
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+const testLVMMetadata = `vg0 {
+id = "Qb1ZQ3-aaaa-bbbb-cccc-dddd-eeee-ffffff"
+seqno = 4
+format = "lvm2" # informational
+status = ["RESIZEABLE", "READ", "WRITE"]
+extent_size = 8192
+
+physical_volumes {
+
+pv0 {
+id = "abcdef-ghij-klmn-opqr-stuv-wxyz-012345"
+device = "/dev/xvdb1"
+status = ["ALLOCATABLE"]
+dev_size = 20969472
+pe_start = 2048
+pe_count = 2559
+}
+
+pv1 {
+id = "zzzzzz-ghij-klmn-opqr-stuv-wxyz-012345"
+pe_count = 400
+}
+}
+
+logical_volumes {
+
+root {
+id = "LVroot-aaaa-bbbb-cccc-dddd-eeee-ffffff"
+status = ["READ", "WRITE", "VISIBLE"]
+segment_count = 2
+
+segment1 {
+start_extent = 0
+extent_count = 1000
+type = "striped"
+stripe_count = 1
+stripes = [
+"pv0", 0
+]
+}
+segment2 {
+start_extent = 1000
+extent_count = 200
+type = "striped"
+stripe_count = 2
+stripes = [
+"pv0", 1000,
+"pv1", 0
+]
+}
+}
+
+other {
+id = "LVothe-aaaa-bbbb-cccc-dddd-eeee-ffffff"
+status = ["READ", "WRITE", "VISIBLE"]
+segment1 {
+extent_count = 50
+stripes = ["pv1", 100]
+}
+}
+}
+}
+# Generated by LVM2
+contents = "Text Format Volume Group"
+version = 1
+description = "Created \"after\" executing 'lvcreate'"
+creation_time = 1700000000
+`
+
+const testThinLVMMetadata = `vg1 {
+id = "Qb1ZQ3-aaaa-bbbb-cccc-dddd-eeee-gggggg"
+format = "lvm2"
+extent_size = 8192
+
+physical_volumes {
+pv0 {
+id = "thinpv-ghij-klmn-opqr-stuv-wxyz-012345"
+pe_count = 1000
+}
+}
+
+logical_volumes {
+pool0 {
+id = "LVpool-aaaa-bbbb-cccc-dddd-eeee-ffffff"
+status = ["READ", "WRITE", "VISIBLE"]
+segment1 {
+start_extent = 0
+extent_count = 500
+type = "thin-pool"
+metadata = "pool0_tmeta"
+pool = "pool0_tdata"
+transaction_id = 1
+chunk_size = 128
+}
+}
+thin1 {
+id = "LVthin-aaaa-bbbb-cccc-dddd-eeee-ffffff"
+status = ["READ", "WRITE", "VISIBLE"]
+segment1 {
+start_extent = 0
+extent_count = 2000
+type = "thin"
+thin_pool = "pool0"
+transaction_id = 0
+device_id = 1
+}
+}
+lvol0_pmspare {
+id = "LVspar-aaaa-bbbb-cccc-dddd-eeee-ffffff"
+status = ["READ", "WRITE"]
+segment1 {
+extent_count = 2
+type = "striped"
+stripes = ["pv0", 502]
+}
+}
+pool0_tmeta {
+id = "LVtmet-aaaa-bbbb-cccc-dddd-eeee-ffffff"
+status = ["READ", "WRITE"]
+segment1 {
+extent_count = 2
+type = "striped"
+stripes = ["pv0", 500]
+}
+}
+pool0_tdata {
+id = "LVtdat-aaaa-bbbb-cccc-dddd-eeee-ffffff"
+status = ["READ", "WRITE"]
+segment1 {
+extent_count = 500
+type = "striped"
+stripes = ["pv0", 0]
+}
+}
+}
+}
+`
+
+func TestParseLVMConfig(t *testing.T) {
+	config, err := parseLVMConfig(testLVMMetadata)
+	if err != nil {
+		t.Fatalf("parseLVMConfig error: %v", err)
+	}
+	if got := config.str("description"); got != `Created "after" executing 'lvcreate'` {
+		t.Errorf("description is %q", got)
+	}
+	vg := config.section("vg0")
+	if vg.int("extent_size") != 8192 || vg.str("format") != "lvm2" || len(vg.array("status")) != 3 {
+		t.Errorf("unexpected volume group %v", vg)
+	}
+
+	for _, text := range []string{"vg0 {\nid = 1\n", "}", "vg0 {\nid = \"x\n}\n", "a b"} {
+		if _, err := parseLVMConfig(text); err == nil {
+			t.Errorf("parseLVMConfig accepted %q", text)
+		}
+	}
+}
+
+func TestLVMPVInfo(t *testing.T) {
+	config, err := parseLVMConfig(testLVMMetadata)
+	if err != nil {
+		t.Fatalf("parseLVMConfig error: %v", err)
+	}
+	const extent = 8192 * 512
+
+	info, err := lvmPVInfo(config, "abcdef-ghij-klmn-opqr-stuv-wxyz-012345")
+	if err != nil {
+		t.Fatalf("lvmPVInfo error: %v", err)
+	}
+	if info.vg != "vg0" || info.format != "lvm2" {
+		t.Errorf("got volume group %q format %q", info.vg, info.format)
+	}
+	if info.size != 2559*extent || info.free != (2559-1100)*extent {
+		t.Errorf("got size %d free %d", info.size, info.free)
+	}
+	if len(info.lvs) != 1 || info.lvs[0].name != "root" || info.lvs[0].size != 1200*extent {
+		t.Errorf("got logical volumes %+v", info.lvs)
+	}
+
+	info, err = lvmPVInfo(config, "zzzzzz-ghij-klmn-opqr-stuv-wxyz-012345")
+	if err != nil {
+		t.Fatalf("lvmPVInfo error: %v", err)
+	}
+	if info.free != (400-150)*extent || len(info.lvs) != 2 {
+		t.Errorf("got free %d logical volumes %+v", info.free, info.lvs)
+	}
+
+	if _, err := lvmPVInfo(config, "missing"); err == nil {
+		t.Errorf("lvmPVInfo found a missing physical volume")
+	}
+}
+
+func TestLVMPVInfoThin(t *testing.T) {
+	config, err := parseLVMConfig(testThinLVMMetadata)
+	if err != nil {
+		t.Fatalf("parseLVMConfig error: %v", err)
+	}
+	const extent = 8192 * 512
+
+	info, err := lvmPVInfo(config, "thinpv-ghij-klmn-opqr-stuv-wxyz-012345")
+	if err != nil {
+		t.Fatalf("lvmPVInfo error: %v", err)
+	}
+	if info.size != 1000*extent || info.free != (1000-504)*extent {
+		t.Errorf("got size %d free %d", info.size, info.free)
+	}
+	// the pool and its thin volume, but not the hidden volumes under them
+	if len(info.lvs) != 2 || info.lvs[0].name != "pool0" || info.lvs[0].size != 500*extent ||
+		info.lvs[1].name != "thin1" || info.lvs[1].size != 2000*extent {
+		t.Errorf("got logical volumes %+v", info.lvs)
+	}
+}
+
+func TestReadLVMMetadata(t *testing.T) {
+	const mdaOffset, mdaSize = 4096, 8192
+	text := "vg0 {\nseqno = 1\n}\n"
+	image := make([]byte, mdaOffset+mdaSize)
+
+	label := image[512:]
+	copy(label, "LABELONE")
+	binary.LittleEndian.PutUint32(label[20:], 32)
+	copy(label[24:], "LVM2 001")
+	locns := label[32+40:]
+	// one data area, then one metadata area
+	binary.LittleEndian.PutUint64(locns[0:], 1<<20)
+	binary.LittleEndian.PutUint64(locns[32:], mdaOffset)
+	binary.LittleEndian.PutUint64(locns[40:], mdaSize)
+
+	// put the text across the end of the circular buffer
+	header := image[mdaOffset:]
+	copy(header[4:], lvmMdaMagic)
+	offset := mdaSize - 5
+	binary.LittleEndian.PutUint64(header[40:], uint64(offset))
+	binary.LittleEndian.PutUint64(header[48:], uint64(len(text)))
+	copy(header[offset:], text[:5])
+	copy(header[lvmMdaHeaderSize:], text[5:])
+
+	got, err := readLVMMetadata(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("readLVMMetadata error: %v", err)
+	}
+	if got != text {
+		t.Errorf("readLVMMetadata got %q, expected %q", got, text)
+	}
+
+	if _, err := readLVMMetadata(bytes.NewReader(make([]byte, 4096))); err == nil {
+		t.Errorf("readLVMMetadata accepted a device without label")
+	}
+}
+
+func TestSplitDMName(t *testing.T) {
+	for in, out := range map[string][2]string{
+		"vg0-root":            {"vg0", "root"},
+		"my--vg-lv--home":     {"my-vg", "lv-home"},
+		"vg-thin--pool-tpool": {"vg", "thin-pool-tpool"},
+	} {
+		vg, lv, ok := splitDMName(in)
+		if !ok || vg != out[0] || lv != out[1] {
+			t.Errorf("splitDMName(%q) = %q, %q, %v, expected %q, %q", in, vg, lv, ok, out[0], out[1])
+		}
+	}
+	if _, _, ok := splitDMName("luks--1234"); ok {
+		t.Errorf("splitDMName split a name without separator")
+	}
+}
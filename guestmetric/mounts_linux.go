@@ -0,0 +1,121 @@
+package guestmetric
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type mountInfo struct {
+	device     string // major:minor of the mounted filesystem
+	root       string // directory of the filesystem mounted, "/" unless a bind mount
+	mountPoint string
+	fsType     string
+	source     string
+}
+
+// unescapeMountField decodes the octal escapes such as "\040" used for
+// spaces and other special characters in mountinfo fields.
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// parseMountInfo parses the format of /proc/<pid>/mountinfo, lines like
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//
+// where a variable number of optional fields precede the "-".
+func parseMountInfo(r io.Reader) ([]mountInfo, error) {
+	var mounts []mountInfo
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+2 >= len(fields) {
+			return nil, fmt.Errorf("Invalid mountinfo line %q", scanner.Text())
+		}
+		mounts = append(mounts, mountInfo{
+			device:     fields[2],
+			root:       unescapeMountField(fields[3]),
+			mountPoint: unescapeMountField(fields[4]),
+			fsType:     fields[sep+1],
+			source:     unescapeMountField(fields[sep+2]),
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+func readMountInfo() ([]mountInfo, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMountInfo(f)
+}
+
+// blockStack returns the block device name followed by the devices stacked
+// on top of it, such as device-mapper devices for LUKS or LVM, or md arrays.
+func blockStack(name string) []string {
+	stack := []string{name}
+	seen := map[string]bool{name: true}
+	for i := 0; i < len(stack); i++ {
+		holders, _ := filepath.Glob(fmt.Sprintf("/sys/class/block/%s/holders/*", stack[i]))
+		for _, holder := range holders {
+			holder = filepath.Base(holder)
+			if !seen[holder] {
+				seen[holder] = true
+				stack = append(stack, holder)
+			}
+		}
+	}
+	return stack
+}
+
+// mountsOf returns the mounts of the block devices, whole filesystems
+// before bind mounts of their subdirectories, each mount point once.
+func mountsOf(devices []string, mounts []mountInfo) []mountInfo {
+	numbers := make(map[string]bool)
+	for _, dev := range devices {
+		if number, err := readSysfs(fmt.Sprintf("/sys/class/block/%s/dev", dev)); err == nil {
+			numbers[number] = true
+		}
+	}
+	var found []mountInfo
+	seen := make(map[string]bool)
+	for _, m := range mounts {
+		if numbers[m.device] && !seen[m.mountPoint] {
+			seen[m.mountPoint] = true
+			found = append(found, m)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].root == "/" && found[j].root != "/"
+	})
+	return found
+}
@@ -0,0 +1,48 @@
+package guestmetric
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	mounts, err := parseMountInfo(strings.NewReader(
+		`22 1 202:1 / / rw,relatime shared:1 - ext4 /dev/xvda1 rw
+36 22 253:0 / /mnt/my\040data rw,noatime shared:20 master:1 - xfs /dev/mapper/luks-1234 rw
+37 22 253:0 /sub /srv/bind rw - xfs /dev/mapper/luks-1234 rw
+`))
+	if err != nil {
+		t.Fatalf("parseMountInfo error: %v", err)
+	}
+	expected := []mountInfo{
+		{"202:1", "/", "/", "ext4", "/dev/xvda1"},
+		{"253:0", "/", "/mnt/my data", "xfs", "/dev/mapper/luks-1234"},
+		{"253:0", "/sub", "/srv/bind", "xfs", "/dev/mapper/luks-1234"},
+	}
+	if len(mounts) != len(expected) {
+		t.Fatalf("got %d mounts, expected %d", len(mounts), len(expected))
+	}
+	for i := range expected {
+		if mounts[i] != expected[i] {
+			t.Errorf("mount %d: got %+v, expected %+v", i, mounts[i], expected[i])
+		}
+	}
+
+	if _, err := parseMountInfo(strings.NewReader("22 1 202:1 / / rw\n")); err == nil {
+		t.Errorf("parseMountInfo accepted a line without separator")
+	}
+}
+
+func TestUnescapeMountField(t *testing.T) {
+	for in, out := range map[string]string{
+		`/plain`:          "/plain",
+		`/a\040b`:         "/a b",
+		`/tab\011x\134y`:  "/tab\tx\\y",
+		`/trailing\04`:    `/trailing\04`,
+		`/not\08escape\1`: `/not\08escape\1`,
+	} {
+		if got := unescapeMountField(in); got != out {
+			t.Errorf("unescapeMountField(%q) = %q, expected %q", in, got, out)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package guestmetric
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// probeSize covers every superblock probed, the furthest being btrfs at
+// 64KiB.
+const probeSize = 0x10000 + 0x1000
+
+type fsProbe struct {
+	fsType string
+	uuid   string
+	label  string
+}
+
+func formatUUID(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// cString returns the NUL terminated, space padded string in b.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimRight(string(b), " ")
+}
+
+func probeExt(buf []byte) *fsProbe {
+	sb := buf[1024:]
+	if binary.LittleEndian.Uint16(sb[56:]) != 0xef53 {
+		return nil
+	}
+	const (
+		compatHasJournal     = 0x4
+		incompatExtents      = 0x40
+		incompat64Bit        = 0x80
+		incompatFlexBg       = 0x200
+		roCompatHugeFile     = 0x8
+		roCompatGdtCsum      = 0x10
+		roCompatDirNlink     = 0x20
+		roCompatExtraIsize   = 0x40
+		roCompatMetadataCsum = 0x400
+	)
+	compat := binary.LittleEndian.Uint32(sb[92:])
+	incompat := binary.LittleEndian.Uint32(sb[96:])
+	roCompat := binary.LittleEndian.Uint32(sb[100:])
+	fsType := "ext2"
+	if incompat&(incompatExtents|incompat64Bit|incompatFlexBg) != 0 ||
+		roCompat&(roCompatHugeFile|roCompatGdtCsum|roCompatDirNlink|roCompatExtraIsize|roCompatMetadataCsum) != 0 {
+		fsType = "ext4"
+	} else if compat&compatHasJournal != 0 {
+		fsType = "ext3"
+	}
+	return &fsProbe{fsType, formatUUID(sb[104:120]), cString(sb[120:136])}
+}
+
+func probeXfs(buf []byte) *fsProbe {
+	if string(buf[0:4]) != "XFSB" {
+		return nil
+	}
+	return &fsProbe{"xfs", formatUUID(buf[32:48]), cString(buf[108:120])}
+}
+
+func probeBtrfs(buf []byte) *fsProbe {
+	sb := buf[0x10000:]
+	if string(sb[0x40:0x48]) != "_BHRfS_M" {
+		return nil
+	}
+	return &fsProbe{"btrfs", formatUUID(sb[0x20:0x30]), cString(sb[0x12b : 0x12b+256])}
+}
+
+func probeVfat(buf []byte) *fsProbe {
+	if buf[510] != 0x55 || buf[511] != 0xaa {
+		return nil
+	}
+	var id, label []byte
+	switch {
+	case string(buf[82:87]) == "FAT32":
+		id, label = buf[67:71], buf[71:82]
+	case string(buf[54:58]) == "FAT1":
+		id, label = buf[39:43], buf[43:54]
+	default:
+		return nil
+	}
+	serial := binary.LittleEndian.Uint32(id)
+	l := cString(label)
+	if l == "NO NAME" {
+		l = ""
+	}
+	return &fsProbe{"vfat", fmt.Sprintf("%04X-%04X", serial>>16, serial&0xffff), l}
+}
+
+func probeSwap(buf []byte) *fsProbe {
+	// the signature ends the first page, whatever the page size was
+	for _, pageSize := range []int{4096, 8192, 16384, 65536} {
+		sig := string(buf[pageSize-10 : pageSize])
+		if sig == "SWAPSPACE2" || sig == "SWAP-SPACE" {
+			return &fsProbe{"swap", formatUUID(buf[1024+12 : 1024+28]), cString(buf[1024+28 : 1024+44])}
+		}
+	}
+	return nil
+}
+
+func probeLVM2(buf []byte) *fsProbe {
+	// the label is in one of the first four sectors
+	for sector := 0; sector < 4; sector++ {
+		label := buf[sector*512:]
+		if string(label[0:8]) == "LABELONE" && string(label[24:32]) == "LVM2 001" {
+			id := string(label[32:64])
+			uuid := strings.Join([]string{id[0:6], id[6:10], id[10:14], id[14:18], id[18:22], id[22:26], id[26:32]}, "-")
+			return &fsProbe{"LVM2_member", uuid, ""}
+		}
+	}
+	return nil
+}
+
+func probeLUKS(buf []byte) *fsProbe {
+	if string(buf[0:6]) != "LUKS\xba\xbe" {
+		return nil
+	}
+	label := ""
+	if binary.BigEndian.Uint16(buf[6:8]) == 2 {
+		label = cString(buf[24:72])
+	}
+	return &fsProbe{"crypto_LUKS", cString(buf[168:208]), label}
+}
+
+// probeSuperblock identifies the filesystem or volume format whose start is
+// in buf, which must be probeSize bytes.
+func probeSuperblock(buf []byte) *fsProbe {
+	for _, probe := range []func([]byte) *fsProbe{
+		probeLUKS, probeLVM2, probeXfs, probeBtrfs, probeExt, probeSwap, probeVfat,
+	} {
+		if p := probe(buf); p != nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// unescapeUdevName decodes the "\x2f" style escapes udev uses in the names
+// of its /dev/disk links.
+func unescapeUdevName(s string) string {
+	if !strings.Contains(s, `\x`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if n, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// byUUIDLink looks for the device among the udev /dev/disk/by-uuid and
+// by-label links, for when it cannot be read.
+func byUUIDLink(path string) *fsProbe {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil
+	}
+	find := func(dir string) string {
+		links, _ := filepath.Glob(dir + "/*")
+		for _, link := range links {
+			if t, err := filepath.EvalSymlinks(link); err == nil && t == target {
+				return unescapeUdevName(filepath.Base(link))
+			}
+		}
+		return ""
+	}
+	uuid := find("/dev/disk/by-uuid")
+	if uuid == "" {
+		return nil
+	}
+	return &fsProbe{uuid: uuid, label: find("/dev/disk/by-label")}
+}
+
+// probeDevice reads the superblock of a block device to find its format,
+// UUID and label.
+func probeDevice(path string) *fsProbe {
+	f, err := os.Open(path)
+	if err != nil {
+		return byUUIDLink(path)
+	}
+	defer f.Close()
+	buf := make([]byte, probeSize)
+	if _, err := io.ReadFull(f, buf); err != nil && err != io.ErrUnexpectedEOF {
+		return byUUIDLink(path)
+	}
+	if p := probeSuperblock(buf); p != nil {
+		return p
+	}
+	return byUUIDLink(path)
+}
@@ -0,0 +1,97 @@
+package guestmetric
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+var testUUID = []byte{
+	0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef,
+	0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef,
+}
+
+const testUUIDString = "01234567-89ab-cdef-0123-456789abcdef"
+
+func TestProbeSuperblock(t *testing.T) {
+	cases := map[string]struct {
+		fill     func(buf []byte)
+		expected fsProbe
+	}{
+		"ext4": {func(buf []byte) {
+			sb := buf[1024:]
+			binary.LittleEndian.PutUint16(sb[56:], 0xef53)
+			binary.LittleEndian.PutUint32(sb[92:], 0x4)
+			binary.LittleEndian.PutUint32(sb[96:], 0x40)
+			copy(sb[104:], testUUID)
+			copy(sb[120:], "root")
+		}, fsProbe{"ext4", testUUIDString, "root"}},
+		"ext3": {func(buf []byte) {
+			sb := buf[1024:]
+			binary.LittleEndian.PutUint16(sb[56:], 0xef53)
+			binary.LittleEndian.PutUint32(sb[92:], 0x4)
+			copy(sb[104:], testUUID)
+		}, fsProbe{"ext3", testUUIDString, ""}},
+		"xfs": {func(buf []byte) {
+			copy(buf, "XFSB")
+			copy(buf[32:], testUUID)
+			copy(buf[108:], "data")
+		}, fsProbe{"xfs", testUUIDString, "data"}},
+		"btrfs": {func(buf []byte) {
+			sb := buf[0x10000:]
+			copy(sb[0x40:], "_BHRfS_M")
+			copy(sb[0x20:], testUUID)
+			copy(sb[0x12b:], "pool")
+		}, fsProbe{"btrfs", testUUIDString, "pool"}},
+		"vfat": {func(buf []byte) {
+			copy(buf[82:], "FAT32   ")
+			binary.LittleEndian.PutUint32(buf[67:], 0x1234abcd)
+			copy(buf[71:], "NO NAME    ")
+			buf[510], buf[511] = 0x55, 0xaa
+		}, fsProbe{"vfat", "1234-ABCD", ""}},
+		"swap": {func(buf []byte) {
+			copy(buf[4096-10:], "SWAPSPACE2")
+			copy(buf[1024+12:], testUUID)
+			copy(buf[1024+28:], "swap0")
+		}, fsProbe{"swap", testUUIDString, "swap0"}},
+		"lvm2": {func(buf []byte) {
+			label := buf[512:]
+			copy(label, "LABELONE")
+			copy(label[24:], "LVM2 001")
+			copy(label[32:], "abcdefghijklmnopqrstuvwxyz012345")
+		}, fsProbe{"LVM2_member", "abcdef-ghij-klmn-opqr-stuv-wxyz-012345", ""}},
+		"luks2": {func(buf []byte) {
+			copy(buf, "LUKS\xba\xbe")
+			binary.BigEndian.PutUint16(buf[6:], 2)
+			copy(buf[24:], "secret")
+			copy(buf[168:], testUUIDString)
+		}, fsProbe{"crypto_LUKS", testUUIDString, "secret"}},
+	}
+	for name, c := range cases {
+		buf := make([]byte, probeSize)
+		c.fill(buf)
+		p := probeSuperblock(buf)
+		if p == nil {
+			t.Errorf("%s: not recognised", name)
+		} else if *p != c.expected {
+			t.Errorf("%s: got %+v, expected %+v", name, *p, c.expected)
+		}
+	}
+
+	if p := probeSuperblock(make([]byte, probeSize)); p != nil {
+		t.Errorf("empty device recognised as %+v", *p)
+	}
+}
+
+func TestUnescapeUdevName(t *testing.T) {
+	for in, out := range map[string]string{
+		`1234-ABCD`:       "1234-ABCD",
+		`my\x20disk`:      "my disk",
+		`a\x2fb`:          "a/b",
+		`trailing\x2`:     `trailing\x2`,
+		`not\xzzescape\x`: `not\xzzescape\x`,
+	} {
+		if got := unescapeUdevName(in); got != out {
+			t.Errorf("unescapeUdevName(%q) = %q, expected %q", in, got, out)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package guestmetric
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	xenstoreclient "github.com/xenserver/xe-guest-utilities/xenstoreclient"
+)
+
+// volumeExpiry is the number of collections a volume must be missing from
+// before its index is given to other volumes.
+const volumeExpiry = 10
+
+// VolumeIndex assigns the N of data/volumes/N to volumes by their stable
+// identifiers, so that a volume keeps its index while others come and go.
+// The index of a volume which stays detached is reused after volumeExpiry
+// collections, so indices do not keep growing as volumes are replaced.
+type VolumeIndex struct {
+	mu      sync.Mutex
+	indices map[string]int
+	missing map[string]int // collections each id has been missing from
+}
+
+func NewVolumeIndex() *VolumeIndex {
+	return &VolumeIndex{indices: make(map[string]int), missing: make(map[string]int)}
+}
+
+// assign returns the index of each of the volume ids. Volumes seen before
+// keep their index, then those in published, which maps ids to the indices
+// found in XenStore with the first id claiming an index keeping it, and new
+// volumes take the lowest index not in use, in the order of their ids.
+func (v *VolumeIndex) assign(ids []string, published map[string]int) map[string]int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	present := make(map[string]bool)
+	for _, id := range ids {
+		present[id] = true
+		delete(v.missing, id)
+	}
+	for id := range v.indices {
+		if present[id] {
+			continue
+		}
+		if v.missing[id]++; v.missing[id] >= volumeExpiry {
+			delete(v.indices, id)
+			delete(v.missing, id)
+		}
+	}
+	used := make(map[int]bool)
+	for _, n := range v.indices {
+		used[n] = true
+	}
+	claimed := make([]string, 0, len(published))
+	for id := range published {
+		claimed = append(claimed, id)
+	}
+	sort.Strings(claimed)
+	for _, id := range claimed {
+		n := published[id]
+		if _, ok := v.indices[id]; !ok && !used[n] {
+			v.indices[id] = n
+			used[n] = true
+		}
+	}
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+	next := 0
+	result := make(map[string]int)
+	for _, id := range sorted {
+		n, ok := v.indices[id]
+		if !ok {
+			for used[next] {
+				next++
+			}
+			n = next
+			v.indices[id] = n
+			used[n] = true
+		}
+		result[id] = n
+	}
+	return result
+}
+
+func (v *VolumeIndex) empty() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(v.indices) == 0
+}
+
+// publishedVolumes reads back the ids of the volumes in data/volumes, such
+// as those a previous xe-daemon left.
+func publishedVolumes(client xenstoreclient.XenStoreClient) map[string]int {
+	published := make(map[string]int)
+	entries, err := client.List("data/volumes")
+	if err != nil {
+		return published
+	}
+	for _, entry := range entries {
+		n, err := strconv.Atoi(entry)
+		if err != nil {
+			continue
+		}
+		if id, err := client.Read(fmt.Sprintf("data/volumes/%d/id", n)); err == nil && id != "" {
+			published[id] = n
+		}
+	}
+	return published
+}
+
+// volumeID identifies a partition by the XenStore id of its virtual block
+// device and its partition number, or else by its filesystem UUID or else
+// its name.
+func volumeID(vbd, name string, probe *fsProbe) string {
+	if vbd != "" {
+		if part, err := readSysfs(fmt.Sprintf("/sys/class/block/%s/partition", name)); err == nil && part != "" {
+			return fmt.Sprintf("vbd-%s-%s", vbd, part)
+		}
+		return "vbd-" + vbd
+	}
+	if probe != nil && probe.uuid != "" {
+		return "uuid-" + probe.uuid
+	}
+	return "dev-" + filepath.Base(name)
+}
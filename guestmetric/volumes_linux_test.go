@@ -0,0 +1,71 @@
+package guestmetric
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVolumeIndexAssign(t *testing.T) {
+	v := NewVolumeIndex()
+	got := v.assign([]string{"vbd-51760-1", "vbd-51712-2", "vbd-51712-1"}, nil)
+	expected := map[string]int{"vbd-51712-1": 0, "vbd-51712-2": 1, "vbd-51760-1": 2}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("first assign got %v, expected %v", got, expected)
+	}
+
+	// a removed volume keeps its index free, a new one takes the next
+	got = v.assign([]string{"vbd-51760-1", "vbd-51712-1", "vbd-51728-1"}, nil)
+	expected = map[string]int{"vbd-51712-1": 0, "vbd-51760-1": 2, "vbd-51728-1": 3}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("hotplug assign got %v, expected %v", got, expected)
+	}
+
+	got = v.assign([]string{"vbd-51712-2"}, nil)
+	expected = map[string]int{"vbd-51712-2": 1}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("replug assign got %v, expected %v", got, expected)
+	}
+}
+
+func TestVolumeIndexPublished(t *testing.T) {
+	v := NewVolumeIndex()
+	published := map[string]int{"uuid-1234": 0, "vbd-51712-1": 1, "vbd-51760-1": 1}
+	got := v.assign([]string{"vbd-51712-1", "uuid-1234", "vbd-51744-1"}, published)
+	// of the two volumes claiming index 1 the first keeps it
+	expected := map[string]int{"uuid-1234": 0, "vbd-51712-1": 1, "vbd-51744-1": 2}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("assign with published got %v, expected %v", got, expected)
+	}
+	got = v.assign([]string{"vbd-51760-1"}, nil)
+	if got["vbd-51760-1"] != 3 {
+		t.Errorf("vbd-51760-1 got index %d, expected 3", got["vbd-51760-1"])
+	}
+}
+
+func TestVolumeIndexExpiry(t *testing.T) {
+	v := NewVolumeIndex()
+	v.assign([]string{"vbd-51712-1", "vbd-51728-1"}, nil)
+
+	// a volume missing for fewer collections than the expiry keeps its index
+	for i := 0; i < volumeExpiry-1; i++ {
+		v.assign([]string{"vbd-51712-1"}, nil)
+	}
+	got := v.assign([]string{"vbd-51712-1", "vbd-51728-1"}, nil)
+	if got["vbd-51728-1"] != 1 {
+		t.Errorf("returning volume got index %d, expected 1", got["vbd-51728-1"])
+	}
+
+	// then its index goes to the next new volume
+	for i := 0; i < volumeExpiry; i++ {
+		v.assign([]string{"vbd-51712-1"}, nil)
+	}
+	got = v.assign([]string{"vbd-51712-1", "vbd-51744-1"}, nil)
+	expected := map[string]int{"vbd-51712-1": 0, "vbd-51744-1": 1}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("assign after expiry got %v, expected %v", got, expected)
+	}
+	got = v.assign([]string{"vbd-51712-1", "vbd-51744-1", "vbd-51728-1"}, nil)
+	if got["vbd-51728-1"] != 2 {
+		t.Errorf("expired volume got index %d, expected 2", got["vbd-51728-1"])
+	}
+}
@@ -0,0 +1,127 @@
+package sys
+
+import (
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// openNetlink opens a netlink socket of protocol subscribed to groups.
+func openNetlink(protocol int, groups uint32) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, protocol)
+	if err != nil {
+		return -1, err
+	}
+	addr := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// readNetlink calls handle with every datagram received on fd, until a
+// receive fails for another reason than the socket buffer overflowing.
+func readNetlink(fd int, handle func(data []byte)) error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.ENOBUFS {
+			// messages were lost, treat it as a change
+			handle(nil)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		handle(buf[:n])
+	}
+}
+
+// notify sends on c unless a notification is already pending.
+func notify(c chan int) {
+	select {
+	case c <- 1:
+	default:
+	}
+}
+
+/*
+ * Send a notification on @c when a network link changes or an address is
+ * added or removed, as reported by rtnetlink. @c should be buffered, as
+ * notifications arriving while one is pending are merged.
+ */
+func NotifyNetworkChanged(c chan int) error {
+	fd, err := openNetlink(syscall.NETLINK_ROUTE,
+		unix.RTMGRP_LINK|unix.RTMGRP_IPV4_IFADDR|unix.RTMGRP_IPV6_IFADDR)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	return readNetlink(fd, func(data []byte) {
+		if data == nil {
+			notify(c)
+			return
+		}
+		msgs, err := syscall.ParseNetlinkMessage(data)
+		if err != nil {
+			return
+		}
+		for _, msg := range msgs {
+			switch msg.Header.Type {
+			case syscall.RTM_NEWADDR, syscall.RTM_DELADDR, syscall.RTM_NEWLINK, syscall.RTM_DELLINK:
+				notify(c)
+				return
+			}
+		}
+	})
+}
+
+// parseUevent returns the environment of a kernel uevent, a header such as
+// "add@/devices/..." followed by NUL separated KEY=value pairs.
+func parseUevent(data []byte) map[string]string {
+	env := make(map[string]string)
+	for i, field := range strings.Split(string(data), "\x00") {
+		if i == 0 {
+			continue
+		}
+		if kv := strings.SplitN(field, "=", 2); len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		}
+	}
+	return env
+}
+
+/*
+ * Send a notification on @c when a block device is added, removed or
+ * changed (e.g. resized), as reported by kernel uevents. @c should be
+ * buffered, as notifications arriving while one is pending are merged.
+ */
+func NotifyBlockChanged(c chan int) error {
+	// group 1 gets the events straight from the kernel rather than from udev
+	fd, err := openNetlink(syscall.NETLINK_KOBJECT_UEVENT, 1)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	return readNetlink(fd, func(data []byte) {
+		if data == nil {
+			notify(c)
+			return
+		}
+		env := parseUevent(data)
+		if env["SUBSYSTEM"] != "block" {
+			return
+		}
+		switch env["ACTION"] {
+		case "add", "remove", "change":
+			notify(c)
+		}
+	})
+}
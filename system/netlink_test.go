@@ -0,0 +1,50 @@
+package sys
+
+import (
+	"testing"
+)
+
+func TestParseUevent(t *testing.T) {
+	for _, c := range []struct {
+		data     string
+		expected map[string]string
+	}{
+		{"", map[string]string{}},
+		{"add@/devices/vbd-51712/block/xvda", map[string]string{}},
+		{
+			"change@/devices/vbd-51712/block/xvda\x00ACTION=change\x00SUBSYSTEM=block\x00DEVNAME=xvda\x00RESIZE=1\x00",
+			map[string]string{"ACTION": "change", "SUBSYSTEM": "block", "DEVNAME": "xvda", "RESIZE": "1"},
+		},
+		{
+			"add@/x\x00ACTION=add\x00NOVALUE\x00EQ=a=b",
+			map[string]string{"ACTION": "add", "EQ": "a=b"},
+		},
+	} {
+		env := parseUevent([]byte(c.data))
+		if len(env) != len(c.expected) {
+			t.Errorf("parseUevent(%q) = %v, expected %v", c.data, env, c.expected)
+			continue
+		}
+		for k, v := range c.expected {
+			if env[k] != v {
+				t.Errorf("parseUevent(%q) = %v, expected %v", c.data, env, c.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	c := make(chan int, 1)
+	notify(c)
+	// a pending notification absorbs later ones rather than blocking
+	notify(c)
+	if len(c) != 1 {
+		t.Errorf("%d notifications pending, expected 1", len(c))
+	}
+	<-c
+	notify(c)
+	if len(c) != 1 {
+		t.Errorf("%d notifications pending after receiving, expected 1", len(c))
+	}
+}
@@ -50,8 +50,8 @@ func timerfdSettime(fd int, flags int, new_value *ITimerSpec,
  * is changed by a user or NTP jump.
  */
 func NotifyResumed(c chan int) {
-	ts := ITimerSpec{Interval: syscall.Timespec{math.MaxInt32, 0},
-		Value: syscall.Timespec{0, 0}}
+	ts := ITimerSpec{Interval: syscall.Timespec{Sec: math.MaxInt32, Nsec: 0},
+		Value: syscall.Timespec{Sec: 0, Nsec: 0}}
 	buf := make([]byte, 8)
 	for {
 		fd, err := timerfdCreate(CLOCK_REALTIME, TFD_CLOEXEC)
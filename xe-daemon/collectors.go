@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	config "github.com/xenserver/xe-guest-utilities/config"
+	guestmetric "github.com/xenserver/xe-guest-utilities/guestmetric"
+)
+
+type collectorEntry struct {
+	divisor int
+	timeout time.Duration
+	name    string
+	Collect func(ctx context.Context) (guestmetric.GuestMetric, error)
+}
+
+type collectorResult struct {
+	name    string
+	metric  guestmetric.GuestMetric
+	err     error
+	elapsed time.Duration
+}
+
+// collectorRunner runs collectors concurrently, remembering the last good
+// results of each to republish them while the collector is late.
+type collectorRunner struct {
+	results chan collectorResult
+	running map[string]bool
+	// collectors dropped while running, whose late results are discarded
+	forgotten map[string]bool
+	lastGood  map[string]guestmetric.GuestMetric
+}
+
+func newCollectorRunner() *collectorRunner {
+	return &collectorRunner{
+		// room for a late result from every collector
+		results:   make(chan collectorResult, len(config.CollectorNames)),
+		running:   make(map[string]bool),
+		forgotten: make(map[string]bool),
+		lastGood:  make(map[string]guestmetric.GuestMetric),
+	}
+}
+
+// forget drops the last results of a collector which is no longer run, and
+// those it is still to deliver.
+func (r *collectorRunner) forget(name string) {
+	delete(r.lastGood, name)
+	if r.running[name] {
+		r.forgotten[name] = true
+	}
+}
+
+// run starts the collectors and waits for each until its timeout, returning
+// the results to publish.
+func (r *collectorRunner) run(collectors []collectorEntry, logger *log.Logger, debug bool) []guestmetric.GuestMetric {
+	var metrics []guestmetric.GuestMetric
+	deadlines := make(map[string]time.Time)
+	timeouts := make(map[string]time.Duration)
+
+	receive := func(result collectorResult) {
+		r.running[result.name] = false
+		_, waiting := deadlines[result.name]
+		delete(deadlines, result.name)
+		if r.forgotten[result.name] {
+			delete(r.forgotten, result.name)
+			return
+		}
+		if result.err != nil {
+			logger.Printf("%s error: %#v\n", result.name, result.err)
+			return
+		}
+		if !waiting {
+			logger.Printf("%s finished late after %v\n", result.name, result.elapsed)
+		} else if debug {
+			logger.Printf("%s finished in %v\n", result.name, result.elapsed)
+		}
+		r.lastGood[result.name] = result.metric
+		metrics = append(metrics, result.metric)
+	}
+
+	// pick up the results of collectors which were late last time
+	for len(r.results) > 0 {
+		receive(<-r.results)
+	}
+
+	for _, collector := range collectors {
+		if r.running[collector.name] {
+			logger.Printf("%s still running from an earlier update, keeping its last results\n", collector.name)
+			metrics = append(metrics, r.lastGood[collector.name])
+			continue
+		}
+		if debug {
+			logger.Printf("Running %s ...\n", collector.name)
+		}
+		r.running[collector.name] = true
+		deadlines[collector.name] = time.Now().Add(collector.timeout)
+		timeouts[collector.name] = collector.timeout
+		go func(collector collectorEntry) {
+			start := time.Now()
+			ctx, cancel := context.WithTimeout(context.Background(), collector.timeout)
+			defer cancel()
+			metric, err := collector.Collect(ctx)
+			r.results <- collectorResult{collector.name, metric, err, time.Since(start)}
+		}(collector)
+	}
+
+	for len(deadlines) > 0 {
+		var next time.Time
+		for _, deadline := range deadlines {
+			if next.IsZero() || deadline.Before(next) {
+				next = deadline
+			}
+		}
+		select {
+		case result := <-r.results:
+			receive(result)
+
+		case <-time.After(time.Until(next)):
+			now := time.Now()
+			for name, deadline := range deadlines {
+				if !now.Before(deadline) {
+					logger.Printf("%s timed out after %v, keeping its last results\n", name, timeouts[name])
+					metrics = append(metrics, r.lastGood[name])
+					delete(deadlines, name)
+				}
+			}
+		}
+	}
+	return metrics
+}
+
+// leastMultiple returns the least common multiple of the divisors, the
+// number of updates after which every collector has run.
+func leastMultiple(collectors []collectorEntry) int {
+	lcm := DivisorLeastMultiple
+	for _, c := range collectors {
+		a, b := lcm, c.divisor
+		for b != 0 {
+			a, b = b, a%b
+		}
+		lcm = lcm / a * c.divisor
+	}
+	return lcm
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	guestmetric "github.com/xenserver/xe-guest-utilities/guestmetric"
+)
+
+var testLogger = log.New(io.Discard, "", 0)
+
+// blockingCollector returns a collector reporting key = the next of values,
+// blocking until there is one, ignoring its context as a hung command would.
+func blockingCollector(name string, values chan string) collectorEntry {
+	return collectorEntry{
+		divisor: 1,
+		timeout: 50 * time.Millisecond,
+		name:    name,
+		Collect: func(ctx context.Context) (guestmetric.GuestMetric, error) {
+			return guestmetric.GuestMetric{"key": <-values}, nil
+		},
+	}
+}
+
+func TestCollectorRunnerTimeout(t *testing.T) {
+	r := newCollectorRunner()
+	values := make(chan string, 1)
+	c := blockingCollector("CollectTest", values)
+
+	values <- "1"
+	metrics := r.run([]collectorEntry{c}, testLogger, false)
+	if len(metrics) != 1 || metrics[0]["key"] != "1" {
+		t.Fatalf("first run got %v", metrics)
+	}
+
+	// a collector timing out is republished with its last good results
+	metrics = r.run([]collectorEntry{c}, testLogger, false)
+	if len(metrics) != 1 || metrics[0]["key"] != "1" {
+		t.Errorf("timed out run got %v, expected the last good results", metrics)
+	}
+
+	// and is not started again while still running
+	metrics = r.run([]collectorEntry{c}, testLogger, false)
+	if len(metrics) != 1 || metrics[0]["key"] != "1" {
+		t.Errorf("still running run got %v, expected the last good results", metrics)
+	}
+
+	// its late result is picked up by the next run
+	values <- "2"
+	for i := 0; i < 100 && len(r.results) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	values <- "3"
+	metrics = r.run([]collectorEntry{c}, testLogger, false)
+	if len(metrics) != 2 || metrics[0]["key"] != "2" || metrics[1]["key"] != "3" {
+		t.Errorf("run after late result got %v, expected the late then the new results", metrics)
+	}
+	if r.lastGood["CollectTest"]["key"] != "3" {
+		t.Errorf("last good results are %v", r.lastGood["CollectTest"])
+	}
+}
+
+func TestCollectorRunnerError(t *testing.T) {
+	r := newCollectorRunner()
+	c := collectorEntry{
+		divisor: 1,
+		timeout: time.Second,
+		name:    "CollectFailing",
+		Collect: func(ctx context.Context) (guestmetric.GuestMetric, error) {
+			return nil, io.ErrUnexpectedEOF
+		},
+	}
+	if metrics := r.run([]collectorEntry{c}, testLogger, false); len(metrics) != 0 {
+		t.Errorf("failing collector published %v", metrics)
+	}
+	if r.running["CollectFailing"] {
+		t.Errorf("failing collector still marked running")
+	}
+}
+
+func TestLeastMultiple(t *testing.T) {
+	for _, c := range []struct {
+		divisors []int
+		expected int
+	}{
+		{nil, DivisorLeastMultiple},
+		{[]int{1, 1}, 2},
+		{[]int{1, 2}, 2},
+		{[]int{3}, 6},
+		{[]int{4, 6}, 12},
+		{[]int{5, 7}, 70},
+	} {
+		var collectors []collectorEntry
+		for _, d := range c.divisors {
+			collectors = append(collectors, collectorEntry{divisor: d})
+		}
+		if got := leastMultiple(collectors); got != c.expected {
+			t.Errorf("leastMultiple(%v) = %d, expected %d", c.divisors, got, c.expected)
+		}
+	}
+}
+
+func TestCollectorRunnerForget(t *testing.T) {
+	r := newCollectorRunner()
+	values := make(chan string, 1)
+	c := blockingCollector("CollectTest", values)
+
+	values <- "1"
+	r.run([]collectorEntry{c}, testLogger, false)
+	// time out, then drop the collector while it is still running
+	r.run([]collectorEntry{c}, testLogger, false)
+	r.forget("CollectTest")
+	if _, ok := r.lastGood["CollectTest"]; ok {
+		t.Errorf("forgotten collector kept its last good results")
+	}
+
+	values <- "2"
+	for i := 0; i < 100 && len(r.results) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if metrics := r.run(nil, testLogger, false); len(metrics) != 0 {
+		t.Errorf("forgotten collector published its late results %v", metrics)
+	}
+	if _, ok := r.lastGood["CollectTest"]; ok {
+		t.Errorf("forgotten collector got last good results from its late run")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -9,10 +10,11 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
-	"strings"
 
+	config "github.com/xenserver/xe-guest-utilities/config"
 	guestmetric "github.com/xenserver/xe-guest-utilities/guestmetric"
 	syslog "github.com/xenserver/xe-guest-utilities/syslog"
 	system "github.com/xenserver/xe-guest-utilities/system"
@@ -20,24 +22,125 @@ import (
 )
 
 const (
-	LoggerName           string = "xe-daemon"
-	DivisorOne           int    = 1
-	DivisorTwo           int    = 2
-	DivisorLeastMultiple int    = 2 // The least common multiple, ensure every collector done before executing InvalidCacheFlush.
-	SysFreezeTimeoutPath string = "/sys/power/pm_freeze_timeout"
+	LoggerName            string = "xe-daemon"
+	DivisorLeastMultiple  int    = 2 // The least common multiple, ensure every collector done before executing InvalidCacheFlush.
+	SysFreezeTimeoutPath  string = "/sys/power/pm_freeze_timeout"
 	ExtendedFreezeTimeout string = "300000"
+	// how long to gather block device events before collecting disks again
+	DiskEventDelay time.Duration = 2 * time.Second
+	// how long to gather rtnetlink events before collecting addresses again
+	NetworkEventDelay time.Duration = 2 * time.Second
 )
 
+// loadConfig reads the configuration file, a missing default file meaning
+// the default configuration, then applies the command line flags given.
+func loadConfig(path string, explicit bool) (*config.Config, error) {
+	cfg, err := config.Load(path)
+	if os.IsNotExist(err) && !explicit {
+		cfg, err = config.Default(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "i":
+			cfg.Interval, _ = strconv.Atoi(f.Value.String())
+		case "d":
+			if f.Value.String() == "true" {
+				cfg.LogLevel = config.LogDebug
+			}
+		case "B":
+			cfg.Balloon = f.Value.String() == "true"
+		}
+	})
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// buildCollectors makes the collectors enabled in cfg, with volumes keeping
+// the indices of data/volumes across reloads.
+func buildCollectors(cfg *config.Config, xs xenstoreclient.XenStoreClient, volumes *guestmetric.VolumeIndex) []collectorEntry {
+	netCfg := cfg.Collectors["network"]
+	diskCfg := cfg.Collectors["disk"]
+	collector := &guestmetric.Collector{
+		Client:         xs,
+		Ballon:         cfg.Balloon,
+		Debug:          cfg.LogLevel == config.LogDebug,
+		NetworkInclude: netCfg.Include,
+		NetworkExclude: netCfg.Exclude,
+		DiskInclude:    diskCfg.Include,
+		DiskExclude:    diskCfg.Exclude,
+		Volumes:        volumes,
+	}
+
+	all := []struct {
+		section string
+		name    string
+		collect func(*guestmetric.Collector) (guestmetric.GuestMetric, error)
+	}{
+		{"os", "CollectOS", (*guestmetric.Collector).CollectOS},
+		{"misc", "CollectMisc", (*guestmetric.Collector).CollectMisc},
+		{"network", "CollectNetworkAddr", (*guestmetric.Collector).CollectNetworkAddr},
+		{"disk", "CollectDisk", (*guestmetric.Collector).CollectDisk},
+		{"memory", "CollectMemory", (*guestmetric.Collector).CollectMemory},
+	}
+	var collectors []collectorEntry
+	for _, c := range all {
+		if cfg.Collectors[c.section].Enabled {
+			collect := c.collect
+			collectors = append(collectors, collectorEntry{
+				divisor: cfg.Divisor(c.section),
+				timeout: cfg.CollectorTimeout(c.section),
+				name:    c.name,
+				Collect: func(ctx context.Context) (guestmetric.GuestMetric, error) {
+					return collect(collector.WithContext(ctx))
+				},
+			})
+		}
+	}
+	return collectors
+}
+
 func main() {
 	var err error
 
-	sleepInterval := flag.Int("i", 60, "Interval between updates (in seconds)")
-	debugFlag := flag.Bool("d", false, "Update to log in addition to xenstore")
-	balloonFlag := flag.Bool("B", true, "Do not report that ballooning is supported")
+	flag.Int("i", 60, "Interval between updates (in seconds)")
+	flag.Bool("d", false, "Update to log in addition to xenstore")
+	flag.Bool("B", true, "Do not report that ballooning is supported")
 	pid := flag.String("p", "", "Write the PID to FILE")
+	configFile := flag.String("c", config.DefaultPath, "Read the configuration from FILE")
+	checkConfig := flag.Bool("check-config", false, "Check the configuration and exit")
 
 	flag.Parse()
 
+	configExplicit := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "c" {
+			configExplicit = true
+		}
+	})
+	cfg, err := loadConfig(*configFile, configExplicit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
+		os.Exit(1)
+	}
+	if *checkConfig {
+		fmt.Printf("Configuration OK: interval %ds, log level %v\n", cfg.Interval, cfg.LogLevel)
+		for _, name := range config.CollectorNames {
+			c := cfg.Collectors[name]
+			if c.Enabled {
+				fmt.Printf("  %s: every %ds, timeout %v\n", name, cfg.Divisor(name)*cfg.Interval, cfg.CollectorTimeout(name))
+			} else {
+				fmt.Printf("  %s: disabled\n", name)
+			}
+		}
+		return
+	}
+	debug := cfg.LogLevel == config.LogDebug
+
 	if *pid != "" {
 		if err = ioutil.WriteFile(*pid, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
 			fmt.Fprintf(os.Stderr, "Write pid to %s error: %s\n", *pid, err)
@@ -47,7 +150,7 @@ func main() {
 
 	var loggerWriter io.Writer = os.Stderr
 	var topic string = LoggerName
-	if w, err := syslog.NewSyslogWriter(topic, *debugFlag); err == nil {
+	if w, err := syslog.NewSyslogWriter(topic, debug); err == nil {
 		loggerWriter = w
 		topic = ""
 	} else {
@@ -56,13 +159,37 @@ func main() {
 	}
 
 	logger := log.New(loggerWriter, topic, 0)
+	infof := func(format string, v ...interface{}) {
+		if cfg.LogLevel >= config.LogInfo {
+			logger.Printf(format, v...)
+		}
+	}
 
 	exitChannel := make(chan os.Signal, 1)
 	signal.Notify(exitChannel, syscall.SIGTERM, syscall.SIGINT)
 
+	reloadChannel := make(chan os.Signal, 1)
+	signal.Notify(reloadChannel, syscall.SIGHUP)
+
 	resumedChannel := make(chan int)
 	go system.NotifyResumed(resumedChannel)
 
+	networkChannel := make(chan int, 1)
+	go func() {
+		if err := system.NotifyNetworkChanged(networkChannel); err != nil {
+			logger.Printf("Watching network changes error: %v\n", err)
+		}
+	}()
+	var networkRefresh <-chan time.Time
+
+	blockChannel := make(chan int, 1)
+	go func() {
+		if err := system.NotifyBlockChanged(blockChannel); err != nil {
+			logger.Printf("Watching block device changes error: %v\n", err)
+		}
+	}()
+	var diskRefresh <-chan time.Time
+
 	// extend pm_freeze_timeout to 5 min when it is default timeout
 	pmFreezeTimeout, err := ioutil.ReadFile(SysFreezeTimeoutPath)
 	if err == nil && strings.TrimSpace(string(pmFreezeTimeout)) == "20000" {
@@ -79,22 +206,77 @@ func main() {
 		return
 	}
 
-	collector := &guestmetric.Collector{
-		Client: xs,
-		Ballon: *balloonFlag,
-		Debug:  *debugFlag,
+	volumes := guestmetric.NewVolumeIndex()
+	collectors := buildCollectors(cfg, xs, volumes)
+	flushDivisor := leastMultiple(collectors)
+	runner := newCollectorRunner()
+
+	// publish writes the metrics, returning whether any write succeeded
+	publish := func(metrics []guestmetric.GuestMetric) bool {
+		updated := false
+		for _, result := range metrics {
+			for name, value := range result {
+				err := xs.Write(name, value)
+				if err != nil {
+					logger.Printf("xenstore.Write error: %v\n", err)
+				} else {
+					if debug {
+						logger.Printf("xenstore.Write OK: %#v: %#v\n", name, value)
+					}
+					updated = true
+				}
+			}
+		}
+		return updated
 	}
 
-	collectors := []struct {
-		divisor int
-		name    string
-		Collect func() (guestmetric.GuestMetric, error)
-	}{
-		{DivisorOne, "CollectOS", collector.CollectOS},
-		{DivisorOne, "CollectMisc", collector.CollectMisc},
-		{DivisorOne, "CollectNetworkAddr", collector.CollectNetworkAddr},
-		{DivisorOne, "CollectDisk", collector.CollectDisk},
-		{DivisorTwo, "CollectMemory", collector.CollectMemory},
+	// remove deletes the keys, returning whether any was removed
+	remove := func(keys guestmetric.GuestMetric) bool {
+		updated := false
+		for key := range keys {
+			if err := xs.Rm(key); err != nil {
+				logger.Printf("xenstore.Rm error: %v\n", err)
+			} else {
+				updated = true
+			}
+		}
+		return updated
+	}
+
+	// refresh runs collectors between updates, straight away removing the
+	// keys they no longer report rather than waiting for the cache flush
+	refresh := func(names ...string) {
+		selected := make(map[string]bool)
+		for _, name := range names {
+			selected[name] = true
+		}
+		var due []collectorEntry
+		previous := make(map[string]guestmetric.GuestMetric)
+		for _, collector := range collectors {
+			if selected[collector.name] {
+				due = append(due, collector)
+				previous[collector.name] = runner.lastGood[collector.name]
+			}
+		}
+		if len(due) == 0 {
+			return
+		}
+		updated := publish(runner.run(due, logger, debug))
+		for _, collector := range due {
+			gone := make(guestmetric.GuestMetric)
+			current := runner.lastGood[collector.name]
+			for key, value := range previous[collector.name] {
+				if _, ok := current[key]; !ok {
+					gone[key] = value
+				}
+			}
+			if remove(gone) {
+				updated = true
+			}
+		}
+		if updated {
+			xs.Write("data/updated", time.Now().Format("Mon Jan _2 15:04:05 2006"))
+		}
 	}
 
 	lastUniqueID, err := xs.Read("unique-domain-id")
@@ -117,31 +299,14 @@ func main() {
 		}
 
 		// invoke collectors
-		updated := false
+		var due []collectorEntry
 		for _, collector := range collectors {
 			if count%collector.divisor == 0 {
-				if *debugFlag {
-					logger.Printf("Running %s ...\n", collector.name)
-				}
-				result, err := collector.Collect()
-				if err != nil {
-					logger.Printf("%s error: %#v\n", collector.name, err)
-				} else {
-					for name, value := range result {
-						err := xs.Write(name, value)
-						if err != nil {
-							logger.Printf("xenstore.Write error: %v\n", err)
-						} else {
-							if *debugFlag {
-								logger.Printf("xenstore.Write OK: %#v: %#v\n", name, value)
-							}
-							updated = true
-						}
-					}
-				}
+				due = append(due, collector)
 			}
 		}
-		if count%DivisorLeastMultiple == 0 {
+		updated := publish(runner.run(due, logger, debug))
+		if count%flushDivisor == 0 {
 			if cx, ok := xs.(*xenstoreclient.CachedXenStore); ok {
 				err := cx.InvalidCacheFlush()
 				if err != nil {
@@ -154,22 +319,96 @@ func main() {
 			xs.Write("data/updated", time.Now().Format("Mon Jan _2 15:04:05 2006"))
 		}
 
-		select {
-		case <-exitChannel:
-			logger.Printf("Received an interrupt, stopping services...\n")
-			if c, ok := loggerWriter.(io.Closer); ok {
-				if err := c.Close(); err != nil {
-					fmt.Fprintf(os.Stderr, "logger close error: %s\n", err)
+		timer := time.NewTimer(time.Duration(cfg.Interval) * time.Second)
+	wait:
+		for {
+			select {
+			case <-exitChannel:
+				infof("Received an interrupt, stopping services...\n")
+				if c, ok := loggerWriter.(io.Closer); ok {
+					if err := c.Close(); err != nil {
+						fmt.Fprintf(os.Stderr, "logger close error: %s\n", err)
+					}
 				}
-			}
-			return
+				return
 
-		case <-resumedChannel:
-			logger.Printf("Trigger refresh after system resume\n")
-			continue
+			case <-resumedChannel:
+				infof("Trigger refresh after system resume\n")
+				break wait
+
+			case <-reloadChannel:
+				newCfg, err := loadConfig(*configFile, configExplicit)
+				if err != nil {
+					logger.Printf("Reload configuration error: %v, keeping the current configuration\n", err)
+					continue
+				}
+				infof("Reloaded configuration from %s\n", *configFile)
+				cfg = newCfg
+				debug = cfg.LogLevel == config.LogDebug
+				previous := collectors
+				collectors = buildCollectors(cfg, xs, volumes)
+				flushDivisor = leastMultiple(collectors)
 
-		case <-time.After(time.Duration(*sleepInterval) * time.Second):
-			continue
+				// remove what the collectors disabled by the reload published
+				enabled := make(map[string]bool)
+				var names []string
+				for _, collector := range collectors {
+					enabled[collector.name] = true
+					names = append(names, collector.name)
+				}
+				removed := false
+				for _, collector := range previous {
+					if !enabled[collector.name] {
+						if remove(runner.lastGood[collector.name]) {
+							removed = true
+						}
+						runner.forget(collector.name)
+					}
+				}
+				if removed {
+					xs.Write("data/updated", time.Now().Format("Mon Jan _2 15:04:05 2006"))
+				}
+				// forget what was written, so that values which drifted in
+				// xenstore are rewritten rather than only those which changed
+				if cx, ok := xs.(*xenstoreclient.CachedXenStore); ok {
+					cx.Clear()
+				}
+
+				// republish now, removing what collectors whose include
+				// and exclude patterns were narrowed no longer report,
+				// and restart the cycle from there
+				refresh(names...)
+				count = 0
+				timer.Reset(time.Duration(cfg.Interval) * time.Second)
+
+			case <-networkChannel:
+				if networkRefresh == nil {
+					networkRefresh = time.After(NetworkEventDelay)
+				}
+
+			case <-networkRefresh:
+				networkRefresh = nil
+				if debug {
+					logger.Printf("Network changed, refreshing addresses\n")
+				}
+				refresh("CollectNetworkAddr")
+
+			case <-blockChannel:
+				if diskRefresh == nil {
+					diskRefresh = time.After(DiskEventDelay)
+				}
+
+			case <-diskRefresh:
+				diskRefresh = nil
+				if debug {
+					logger.Printf("Block devices changed, refreshing disks\n")
+				}
+				refresh("CollectDisk")
+
+			case <-timer.C:
+				break wait
+			}
 		}
+		timer.Stop()
 	}
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	xenstoreclient "github.com/xenserver/xe-guest-utilities/xenstoreclient"
+)
+
+type bench_op func(xs xenstoreclient.XenStoreClient, key string) (retries int, err error)
+
+var bench_ops = map[string]func(value string) bench_op{
+	"read": func(value string) bench_op {
+		return func(xs xenstoreclient.XenStoreClient, key string) (int, error) {
+			_, err := xs.Read(key)
+			return 0, err
+		}
+	},
+	"write": func(value string) bench_op {
+		return func(xs xenstoreclient.XenStoreClient, key string) (int, error) {
+			return 0, xs.Write(key, value)
+		}
+	},
+	"list": func(value string) bench_op {
+		return func(xs xenstoreclient.XenStoreClient, key string) (int, error) {
+			_, err := xs.List(key[:strings.LastIndex(key, "/")])
+			return 0, err
+		}
+	},
+	"tx": func(value string) bench_op {
+		return func(xs xenstoreclient.XenStoreClient, key string) (int, error) {
+			retries := -1
+			err := with_transaction(xs, func() error {
+				retries++
+				if _, err := xs.Read(key); err != nil {
+					return err
+				}
+				return xs.Write(key, value)
+			})
+			return retries, err
+		}
+	},
+}
+
+type bench_result struct {
+	name      string
+	latencies []time.Duration
+	errors    int
+	retries   int
+	elapsed   time.Duration
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func (r *bench_result) print() {
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	n := len(r.latencies)
+	fmt.Printf("%-6s %8d %10.1f %10v %10v %10v %10v %6d %6d\n", r.name, n,
+		float64(n)/r.elapsed.Seconds(),
+		percentile(r.latencies, 50), percentile(r.latencies, 90),
+		percentile(r.latencies, 99), percentile(r.latencies, 100),
+		r.errors, r.retries)
+}
+
+func run_bench(name string, op bench_op, conns []xenstoreclient.XenStoreClient, keys []string, ops int) *bench_result {
+	result := &bench_result{name: name}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	for c, xs := range conns {
+		wg.Add(1)
+		go func(c int, xs xenstoreclient.XenStoreClient) {
+			defer wg.Done()
+			latencies := make([]time.Duration, 0, ops)
+			errors, retries := 0, 0
+			for i := 0; i < ops; i++ {
+				key := keys[(c*ops+i)%len(keys)]
+				t := time.Now()
+				r, err := op(xs, key)
+				latencies = append(latencies, time.Since(t))
+				retries += r
+				if err != nil {
+					errors++
+				}
+			}
+			mutex.Lock()
+			result.latencies = append(result.latencies, latencies...)
+			result.errors += errors
+			result.retries += retries
+			mutex.Unlock()
+		}(c, xs)
+	}
+	wg.Wait()
+	result.elapsed = time.Since(start)
+	return result
+}
+
+func xs_bench(script_name string, args []string) {
+	fs := flag.NewFlagSet(script_name, flag.ExitOnError)
+	workloads := fs.String("workload", "write,read,list,tx", "comma separated `LIST` of read, write, list and tx workloads")
+	ops := fs.Int("ops", 1000, "operations per client per workload `N`")
+	clients := fs.Int("clients", 1, "number of concurrent connections `N`")
+	nkeys := fs.Int("keys", 100, "number of scratch keys `N`")
+	size := fs.Int("size", 16, "value size in `BYTES`")
+	root := fs.String("path", "", "scratch subtree `PATH`, removed afterwards (default data/xenstore-bench-PID)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [--workload LIST] [--ops N] [--clients N] [--keys N] [--size BYTES] [--path PATH]\n", script_name)
+		fmt.Fprintln(os.Stderr, "Set XENSTORED_PATH to run against a xenstored socket instead of xenbus.")
+		fs.PrintDefaults()
+		os.Exit(EXIT_USAGE)
+	}
+	parse_flags(fs, args)
+	if fs.NArg() != 0 || *ops < 1 || *clients < 1 || *nkeys < 1 || *size < 0 {
+		fs.Usage()
+	}
+	if *root == "" {
+		*root = "data/xenstore-bench-" + strconv.Itoa(os.Getpid())
+	}
+
+	var selected []string
+	for _, name := range strings.Split(*workloads, ",") {
+		if _, ok := bench_ops[name]; !ok {
+			die_usage("%s error: unknown workload %q", script_name, name)
+		}
+		selected = append(selected, name)
+	}
+
+	conns := make([]xenstoreclient.XenStoreClient, *clients)
+	for i := range conns {
+		conns[i] = new_xs()
+	}
+	xs := conns[0]
+
+	value := strings.Repeat("x", *size)
+	keys := make([]string, *nkeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s/%d", *root, i)
+		if err := xs.Write(keys[i], value); err != nil {
+			xs.Rm(*root)
+			die("%s error: %s: %v", script_name, keys[i], err)
+		}
+	}
+
+	cleanup := func(xs xenstoreclient.XenStoreClient) {
+		if err := xs.Rm(*root); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: failed to remove %s: %v\n", script_name, *root, err)
+		}
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		// the connections may be mid request, so clean up on a fresh one
+		cleanup(new_xs())
+		os.Exit(EXIT_ERROR)
+	}()
+
+	fmt.Printf("%-6s %8s %10s %10s %10s %10s %10s %6s %6s\n",
+		"OP", "COUNT", "OPS/S", "P50", "P90", "P99", "MAX", "ERRORS", "RETRY")
+	for _, name := range selected {
+		run_bench(name, bench_ops[name](value), conns, keys, *ops).print()
+	}
+
+	signal.Stop(interrupt)
+	cleanup(xs)
+}
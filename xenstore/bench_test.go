@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	xenstoreclient "github.com/xenserver/xe-guest-utilities/xenstoreclient"
+)
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for _, c := range []struct {
+		p        float64
+		expected time.Duration
+	}{
+		{0, 1},
+		{50, 5},
+		{90, 9},
+		{99, 10},
+		{100, 10},
+	} {
+		if got := percentile(sorted, c.p); got != c.expected {
+			t.Errorf("percentile(%v) = %v, expected %v", c.p, got, c.expected)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("percentile of nothing = %v, expected 0", got)
+	}
+}
+
+func TestRunBench(t *testing.T) {
+	xs := test_xs(t)
+	other, err := xenstoreclient.NewXenstore(0)
+	if err != nil {
+		t.Fatalf("NewXenstore error: %v", err)
+	}
+	defer other.Close()
+	conns := []xenstoreclient.XenStoreClient{xs, other}
+	keys := []string{"data/bench/0", "data/bench/1", "data/bench/2"}
+
+	for _, name := range []string{"write", "read", "list", "tx"} {
+		r := run_bench(name, bench_ops[name]("value"), conns, keys, 10)
+		if len(r.latencies) != 20 || r.errors != 0 {
+			t.Errorf("%s: %d operations with %d errors, expected 20 without errors", name, len(r.latencies), r.errors)
+		}
+	}
+	for _, key := range keys {
+		if value, err := xs.Read(key); err != nil || value != "value" {
+			t.Errorf("%s = %q, %v after the benchmark, expected %q", key, value, err, "value")
+		}
+	}
+
+	// reading keys which do not exist counts errors rather than stopping
+	r := run_bench("read", bench_ops["read"]("value"), conns[:1], []string{"data/missing/0"}, 5)
+	if len(r.latencies) != 5 || r.errors != 5 {
+		t.Errorf("read of a missing key: %d operations with %d errors, expected 5 and 5", len(r.latencies), r.errors)
+	}
+}
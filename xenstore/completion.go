@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// completion_cmds lists the subcommands offered for completion with their
+// options, and whether a xenstore-<name> link to the binary is installed.
+var completion_cmds = []struct {
+	name    string
+	flags   []string
+	symlink bool
+	paths   bool
+}{
+	{"read", []string{"-p", "-R"}, true, true},
+	{"list", []string{"-p"}, true, true},
+	{"write", []string{"-R", "-f"}, true, true},
+	{"rm", []string{"-t"}, true, true},
+	{"exists", nil, true, true},
+	{"mkdir", nil, true, true},
+	{"getperms", nil, true, true},
+	{"ls", []string{"-f", "-p", "--max-depth", "--sort", "--no-values"}, true, true},
+	{"chmod", []string{"-r", "-u"}, true, true},
+	{"watch", []string{"-n"}, true, true},
+	{"shell", nil, false, false},
+	{"find", []string{"--key", "--value", "--max-depth", "--values", "--json"}, false, true},
+	{"dump", []string{"--no-perms"}, false, true},
+	{"diff", []string{"--perms", "--interval", "--count"}, false, true},
+	{"cp", []string{"-r", "-p"}, false, true},
+	{"mv", nil, false, true},
+	{"stat", []string{"--top", "--json"}, false, true},
+	{"monitor", []string{"--interval", "--text", "--top"}, false, true},
+	{"bench", []string{"--workload", "--ops", "--clients", "--keys", "--size", "--path"}, false, false},
+	{"env", []string{"--prefix", "--naming", "--all", "--max-depth", "--export"}, false, true},
+	{"completion", nil, false, false},
+	{"serve", []string{"--socket", "--load", "--domid", "--verbose"}, false, false},
+	{"proxy", []string{"--listen", "--upstream", "--log"}, false, false},
+}
+
+func completion_names(symlinks bool) []string {
+	var names []string
+	for _, c := range completion_cmds {
+		if !symlinks {
+			names = append(names, c.name)
+		} else if c.symlink {
+			names = append(names, "xenstore-"+c.name)
+		}
+	}
+	return names
+}
+
+// xs_complete prints the keys completing prefix, one per line, with a
+// trailing slash on those which have children.
+func xs_complete(script_name string, args []string) {
+	prefix := ""
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+	dir, base := "", prefix
+	if slash := strings.LastIndex(prefix, "/"); slash >= 0 {
+		dir, base = prefix[:slash+1], prefix[slash+1:]
+	}
+
+	xs := new_xs()
+	list_path := strings.TrimSuffix(dir, "/")
+	if dir == "/" {
+		list_path = "/"
+	} else if dir == "" {
+		domain_id, err := xs.Read("domid")
+		if err != nil {
+			os.Exit(1)
+		}
+		domain_path, err := xs.GetDomainPath(strings.TrimRight(domain_id, "\x00"))
+		if err != nil {
+			os.Exit(1)
+		}
+		list_path = strings.TrimRight(domain_path, "\x00")
+	}
+
+	children, err := xs.List(list_path)
+	if err != nil {
+		os.Exit(1)
+	}
+	var matches []string
+	for _, child := range children {
+		if strings.HasPrefix(child, base) {
+			matches = append(matches, child)
+		}
+	}
+	sort.Strings(matches)
+	for _, child := range matches {
+		suffix := ""
+		// only look for grandchildren when there are few candidates
+		if len(matches) <= 50 {
+			if sub, err := xs.List(join_path(list_path, child)); err == nil && len(sub) > 0 {
+				suffix = "/"
+			}
+		}
+		fmt.Println(dir + child + suffix)
+	}
+}
+
+func bash_completion() string {
+	var b strings.Builder
+	b.WriteString(`# bash completion for xenstore, generated by "xenstore completion bash"
+_xenstore()
+{
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local prog="${COMP_WORDS[0]##*/}"
+    local cmd
+
+    if [[ "$prog" == xenstore-* ]]; then
+        cmd="${prog#xenstore-}"
+    elif [[ $COMP_CWORD -eq 1 ]]; then
+        COMPREPLY=( $(compgen -W "` + strings.Join(completion_names(false), " ") + `" -- "$cur") )
+        return
+    else
+        cmd="${COMP_WORDS[1]}"
+    fi
+
+    if [[ "$cur" == -* ]]; then
+        case "$cmd" in
+`)
+	for _, c := range completion_cmds {
+		if len(c.flags) != 0 {
+			fmt.Fprintf(&b, "            %s) COMPREPLY=( $(compgen -W \"%s\" -- \"$cur\") ) ;;\n", c.name, strings.Join(c.flags, " "))
+		}
+	}
+	b.WriteString(`        esac
+        return
+    fi
+
+    case "$cmd" in
+        ` + strings.Join(path_cmds(), "|") + `)
+            local IFS=$'\n'
+            COMPREPLY=( $(xenstore __complete "$cur" 2>/dev/null) )
+            if [[ ${#COMPREPLY[@]} -eq 1 && "${COMPREPLY[0]}" == */ ]]; then
+                compopt -o nospace 2>/dev/null
+            fi
+            ;;
+    esac
+}
+complete -F _xenstore xenstore ` + strings.Join(completion_names(true), " ") + "\n")
+	return b.String()
+}
+
+func zsh_completion() string {
+	var b strings.Builder
+	b.WriteString(`#compdef xenstore ` + strings.Join(completion_names(true), " ") + `
+# zsh completion for xenstore, generated by "xenstore completion zsh"
+_xenstore() {
+  local cmd prog=${words[1]:t}
+  if [[ $prog == xenstore-* ]]; then
+    cmd=${prog#xenstore-}
+  elif (( CURRENT == 2 )); then
+    compadd -- ` + strings.Join(completion_names(false), " ") + `
+    return
+  else
+    cmd=${words[2]}
+  fi
+
+  if [[ $PREFIX == -* ]]; then
+    case $cmd in
+`)
+	for _, c := range completion_cmds {
+		if len(c.flags) != 0 {
+			fmt.Fprintf(&b, "      %s) compadd -- %s ;;\n", c.name, strings.Join(c.flags, " "))
+		}
+	}
+	b.WriteString(`    esac
+    return
+  fi
+
+  case $cmd in
+    ` + strings.Join(path_cmds(), "|") + `)
+      local -a keys
+      keys=(${(f)"$(xenstore __complete $PREFIX 2>/dev/null)"})
+      compadd -Q -S '' -- ${(M)keys:#*/}
+      compadd -Q -- ${keys:#*/}
+      ;;
+  esac
+}
+compdef _xenstore xenstore ` + strings.Join(completion_names(true), " ") + "\n")
+	return b.String()
+}
+
+func fish_completion() string {
+	var b strings.Builder
+	b.WriteString(`# fish completion for xenstore, generated by "xenstore completion fish"
+function __xenstore_keys
+    xenstore __complete (commandline -ct) 2>/dev/null
+end
+
+complete -c xenstore -f
+complete -c xenstore -n '__fish_use_subcommand' -a '` + strings.Join(completion_names(false), " ") + `'
+`)
+	for _, c := range completion_cmds {
+		progs := []string{"xenstore"}
+		if c.symlink {
+			progs = append(progs, "xenstore-"+c.name)
+		}
+		for _, prog := range progs {
+			cond := ""
+			if prog == "xenstore" {
+				cond = fmt.Sprintf(" -n '__fish_seen_subcommand_from %s'", c.name)
+			} else {
+				fmt.Fprintf(&b, "complete -c %s -f\n", prog)
+			}
+			for _, f := range c.flags {
+				opt := "-s " + strings.TrimPrefix(f, "-")
+				if strings.HasPrefix(f, "--") {
+					opt = "-l " + strings.TrimPrefix(f, "--")
+				}
+				fmt.Fprintf(&b, "complete -c %s%s %s\n", prog, cond, opt)
+			}
+			if c.paths {
+				fmt.Fprintf(&b, "complete -c %s%s -a '(__xenstore_keys)'\n", prog, cond)
+			}
+		}
+	}
+	return b.String()
+}
+
+func path_cmds() []string {
+	var names []string
+	for _, c := range completion_cmds {
+		if c.paths {
+			names = append(names, c.name)
+		}
+	}
+	return names
+}
+
+func xs_completion(script_name string, args []string) {
+	if len(args) != 1 {
+		die_usage("Usage: %s bash|zsh|fish", script_name)
+	}
+	switch args[0] {
+	case "bash":
+		fmt.Print(bash_completion())
+	case "zsh":
+		fmt.Print(zsh_completion())
+	case "fish":
+		fmt.Print(fish_completion())
+	default:
+		die_usage("Usage: %s bash|zsh|fish", script_name)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompletionNames(t *testing.T) {
+	names := completion_names(false)
+	if len(names) != len(completion_cmds) {
+		t.Errorf("completion_names(false) has %d names, expected %d", len(names), len(completion_cmds))
+	}
+	links := completion_names(true)
+	for _, expected := range []string{"xenstore-read", "xenstore-ls", "xenstore-watch"} {
+		if !contains(links, expected) {
+			t.Errorf("completion_names(true) = %q, missing %q", links, expected)
+		}
+	}
+	for _, unexpected := range []string{"xenstore-shell", "xenstore-cp", "shell"} {
+		if contains(links, unexpected) {
+			t.Errorf("completion_names(true) = %q, unexpected %q", links, unexpected)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCompletionScripts(t *testing.T) {
+	for _, c := range []struct {
+		shell  string
+		script string
+		link   string
+	}{
+		{"bash", bash_completion(), " xenstore-chmod"},
+		{"zsh", zsh_completion(), " xenstore-chmod"},
+		{"fish", fish_completion(), "complete -c xenstore-chmod -s r"},
+	} {
+		for _, cmd := range completion_cmds {
+			if !strings.Contains(c.script, cmd.name) {
+				t.Errorf("%s completion is missing command %s", c.shell, cmd.name)
+			}
+			for _, f := range cmd.flags {
+				if !strings.Contains(c.script, strings.TrimLeft(f, "-")) {
+					t.Errorf("%s completion is missing %s option %s", c.shell, cmd.name, f)
+				}
+			}
+		}
+		if !strings.Contains(c.script, c.link) {
+			t.Errorf("%s completion does not contain %q", c.shell, c.link)
+		}
+		if strings.Contains(c.script, "xenstore-shell") {
+			t.Errorf("%s completion completes xenstore-shell, which is not installed", c.shell)
+		}
+
+		// check the syntax with the shell itself where it is installed
+		sh, err := exec.LookPath(c.shell)
+		if err != nil {
+			continue
+		}
+		file := filepath.Join(t.TempDir(), "completion."+c.shell)
+		if err := os.WriteFile(file, []byte(c.script), 0644); err != nil {
+			t.Fatal(err)
+		}
+		flag := "-n"
+		if c.shell == "fish" {
+			flag = "--no-execute"
+		}
+		if out, err := exec.Command(sh, flag, file).CombinedOutput(); err != nil {
+			t.Errorf("%s completion does not parse: %v\n%s", c.shell, err, out)
+		}
+	}
+}
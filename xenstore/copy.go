@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	xenstoreclient "github.com/xenserver/xe-guest-utilities/xenstoreclient"
+)
+
+// with_transaction runs fn inside a transaction, running it again from the
+// start whenever the commit fails because of a conflicting change.
+func with_transaction(xs xenstoreclient.XenStoreClient, fn func() error) error {
+	for {
+		if _, err := xs.TransactionStart(); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			xs.TransactionEnd(false)
+			return err
+		}
+		err := xs.TransactionEnd(true)
+		if err == nil || err.Error() != "EAGAIN" {
+			return err
+		}
+	}
+}
+
+type copy_node struct {
+	value string
+	perms []xenstoreclient.Permission
+}
+
+// read_subtree reads src, and its descendants if recursive, keyed by their
+// path relative to src.
+func read_subtree(xs xenstoreclient.XenStoreClient, src string, recursive bool, with_perms bool) (map[string]copy_node, error) {
+	max_depth := 0
+	if recursive {
+		max_depth = -1
+	}
+	nodes := make(map[string]copy_node)
+	var walk_err error
+	walk_tree(xs, src, max_depth, func(path string, depth int, err error) {
+		if walk_err != nil {
+			return
+		}
+		if err != nil {
+			walk_err = fmt.Errorf("%s: %w", path, err)
+			return
+		}
+		var node copy_node
+		if node.value, err = xs.Read(path); err != nil {
+			walk_err = fmt.Errorf("%s: %w", path, err)
+			return
+		}
+		if with_perms {
+			if node.perms, err = xs.GetPermission(path); err != nil {
+				walk_err = fmt.Errorf("%s: %w", path, err)
+				return
+			}
+		}
+		nodes[rel_path(src, path)] = node
+	})
+	return nodes, walk_err
+}
+
+func write_subtree(xs xenstoreclient.XenStoreClient, dst string, nodes map[string]copy_node) error {
+	paths := make([]string, 0, len(nodes))
+	for p := range nodes {
+		paths = append(paths, p)
+	}
+	// parents sort before their children
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		path := dst
+		if p != "" {
+			path = join_path(dst, p)
+		}
+		node := nodes[p]
+		if err := xs.Write(path, node.value); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if node.perms != nil {
+			if err := xs.SetPermission(path, node.perms); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+func is_subpath(path string, parent string) bool {
+	parent = strings.TrimRight(parent, "/")
+	return path == parent || strings.HasPrefix(path, parent+"/")
+}
+
+// do_cp copies src to dst, with its descendants if recursive, in a single
+// transaction.
+func do_cp(xs xenstoreclient.XenStoreClient, src string, dst string, recursive bool, with_perms bool) error {
+	return with_transaction(xs, func() error {
+		nodes, err := read_subtree(xs, src, recursive, with_perms)
+		if err != nil {
+			return err
+		}
+		return write_subtree(xs, dst, nodes)
+	})
+}
+
+// do_mv moves the subtree at src to dst, with its permissions, in a single
+// transaction.
+func do_mv(xs xenstoreclient.XenStoreClient, src string, dst string) error {
+	return with_transaction(xs, func() error {
+		nodes, err := read_subtree(xs, src, true, true)
+		if err != nil {
+			return err
+		}
+		if err := write_subtree(xs, dst, nodes); err != nil {
+			return err
+		}
+		return xs.Rm(src)
+	})
+}
+
+func xs_cp(script_name string, args []string) {
+	cp_usage := func() {
+		die_usage("Usage: %s [-r] [-p] src dst", script_name)
+	}
+	opts, args := get_opts(args, "rp", cp_usage)
+	if len(args) != 2 {
+		cp_usage()
+	}
+	src, dst := args[0], args[1]
+	if opts['r'] && is_subpath(dst, src) {
+		die("%s error: cannot copy %s into itself", script_name, src)
+	}
+
+	if err := do_cp(new_xs(), src, dst, opts['r'], opts['p']); err != nil {
+		die("%s error: %v", script_name, err)
+	}
+}
+
+func xs_mv(script_name string, args []string) {
+	if len(args) != 2 || args[0] == "-h" {
+		die_usage("Usage: %s src dst", script_name)
+	}
+	src, dst := args[0], args[1]
+	if is_subpath(dst, src) {
+		die("%s error: cannot move %s into itself", script_name, src)
+	}
+
+	if err := do_mv(new_xs(), src, dst); err != nil {
+		die("%s error: %v", script_name, err)
+	}
+}
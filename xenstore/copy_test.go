@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	xenstoreclient "github.com/xenserver/xe-guest-utilities/xenstoreclient"
+)
+
+func TestIsSubpath(t *testing.T) {
+	for _, c := range []struct {
+		path     string
+		parent   string
+		expected bool
+	}{
+		{"data/a", "data/a", true},
+		{"data/a/b", "data/a", true},
+		{"data/a/b", "data/a/", true},
+		{"data/ab", "data/a", false},
+		{"data", "data/a", false},
+		{"/local/domain/1/data/a", "data", false},
+	} {
+		if got := is_subpath(c.path, c.parent); got != c.expected {
+			t.Errorf("is_subpath(%q, %q) = %v, expected %v", c.path, c.parent, got, c.expected)
+		}
+	}
+}
+
+// write_tree writes path = value pairs, setting the permissions of those
+// given in perms.
+func write_tree(t *testing.T, xs xenstoreclient.XenStoreClient, values map[string]string, perms map[string]string) {
+	for path, value := range values {
+		if err := xs.Write(path, value); err != nil {
+			t.Fatalf("write %s error: %v", path, err)
+		}
+	}
+	for path, modes := range perms {
+		p, _ := parse_perms(strings.Fields(modes))
+		if err := xs.SetPermission(path, p); err != nil {
+			t.Fatalf("setperms %s error: %v", path, err)
+		}
+	}
+}
+
+// check_tree checks the values and permissions of the paths, "" standing
+// for a missing node.
+func check_tree(t *testing.T, xs xenstoreclient.XenStoreClient, name string, expected map[string]string) {
+	for path, want := range expected {
+		value, err := xs.Read(path)
+		if err != nil {
+			value = ""
+		} else if p, err := xs.GetPermission(path); err == nil {
+			value += " " + strings.Join(perms_str(p), " ")
+		}
+		if value != want {
+			t.Errorf("%s: %s is %q, expected %q", name, path, value, want)
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	xs := test_xs(t)
+	write_tree(t, xs, map[string]string{"data/src": "top", "data/src/a": "1", "data/src/a/b": "2", "data/src/c": "3"},
+		map[string]string{"data/src/a": "n1 r0", "data/src/a/b": "b1"})
+
+	for _, c := range []struct {
+		dst        string
+		recursive  bool
+		with_perms bool
+		expected   map[string]string
+	}{
+		{"data/one", false, false, map[string]string{"data/one": "top n0", "data/one/a": ""}},
+		{"data/all", true, false, map[string]string{
+			"data/all": "top n0", "data/all/a": "1 n0", "data/all/a/b": "2 n0", "data/all/c": "3 n0"}},
+		{"data/perms", true, true, map[string]string{
+			"data/perms": "top n0", "data/perms/a": "1 n1 r0", "data/perms/a/b": "2 b1", "data/perms/c": "3 n0"}},
+	} {
+		if err := do_cp(xs, "data/src", c.dst, c.recursive, c.with_perms); err != nil {
+			t.Errorf("cp to %s error: %v", c.dst, err)
+			continue
+		}
+		check_tree(t, xs, "cp to "+c.dst, c.expected)
+	}
+	check_tree(t, xs, "cp source", map[string]string{"data/src/a": "1 n1 r0", "data/src/a/b": "2 b1"})
+
+	err := do_cp(xs, "data/missing", "data/dst", true, false)
+	if err == nil || exit_status(err) != EXIT_NOT_FOUND {
+		t.Errorf("cp of a missing node error = %v, expected ENOENT", err)
+	}
+}
+
+func TestMove(t *testing.T) {
+	xs := test_xs(t)
+	write_tree(t, xs, map[string]string{"data/src/a": "1", "data/src/a/b": "2"},
+		map[string]string{"data/src/a/b": "b1"})
+
+	if err := do_mv(xs, "data/src", "data/dst"); err != nil {
+		t.Fatalf("mv error: %v", err)
+	}
+	check_tree(t, xs, "mv", map[string]string{
+		"data/src": "", "data/src/a": "", "data/dst": " n0", "data/dst/a": "1 n0", "data/dst/a/b": "2 b1"})
+}
+
+func TestWithTransactionRetry(t *testing.T) {
+	xs := test_xs(t)
+	other, err := xenstoreclient.NewXenstore(0)
+	if err != nil {
+		t.Fatalf("NewXenstore error: %v", err)
+	}
+	defer other.Close()
+	write_tree(t, xs, map[string]string{"data/count": "1"}, nil)
+
+	// a conflicting change made during the first run makes it start over
+	runs := 0
+	err = with_transaction(xs, func() error {
+		runs++
+		count, err := xs.Read("data/count")
+		if err != nil {
+			return err
+		}
+		if runs == 1 {
+			if err := other.Write("data/count", "5"); err != nil {
+				t.Fatalf("conflicting write error: %v", err)
+			}
+		}
+		return xs.Write("data/copy", count)
+	})
+	if err != nil {
+		t.Fatalf("with_transaction error: %v", err)
+	}
+	if runs != 2 {
+		t.Errorf("transaction ran %d times, expected 2", runs)
+	}
+	check_tree(t, xs, "retry", map[string]string{"data/copy": "5 n0"})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	xenstoreclient "github.com/xenserver/xe-guest-utilities/xenstoreclient"
+)
+
+// diff_snapshots writes the added, removed and changed nodes of b relative
+// to a, returning the number of differences found.
+func diff_snapshots(w io.Writer, a *snapshot, b *snapshot, with_perms bool) int {
+	paths := make(map[string]bool)
+	for p := range a.Nodes {
+		paths[p] = true
+	}
+	for p := range b.Nodes {
+		paths[p] = true
+	}
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	display := func(p string) string {
+		if p == "" {
+			return b.Root
+		}
+		return join_path(b.Root, p)
+	}
+	show := func(n snapshot_node) string {
+		v, err := n.value()
+		if err != nil {
+			return fmt.Sprintf("<%v>", err)
+		}
+		return "\"" + sanitise_value(v) + "\""
+	}
+
+	count := 0
+	for _, p := range sorted {
+		old, in_a := a.Nodes[p]
+		cur, in_b := b.Nodes[p]
+		switch {
+		case !in_a:
+			fmt.Fprintf(w, "+ %s = %s\n", display(p), show(cur))
+			count++
+		case !in_b:
+			fmt.Fprintf(w, "- %s = %s\n", display(p), show(old))
+			count++
+		default:
+			if old.Value != cur.Value || old.Encoding != cur.Encoding {
+				fmt.Fprintf(w, "~ %s: %s -> %s\n", display(p), show(old), show(cur))
+				count++
+			}
+			if with_perms && old.Perms != nil && cur.Perms != nil {
+				old_perms := strings.Join(old.Perms, " ")
+				cur_perms := strings.Join(cur.Perms, " ")
+				if old_perms != cur_perms {
+					fmt.Fprintf(w, "~ %s: perms %s -> %s\n", display(p), old_perms, cur_perms)
+					count++
+				}
+			}
+		}
+	}
+	return count
+}
+
+// snapshot_file returns the file name of an argument naming a snapshot,
+// given as @file so it cannot be mistaken for a live path.
+func snapshot_file(arg string) (string, bool) {
+	if !strings.HasPrefix(arg, "@") {
+		return "", false
+	}
+	return arg[1:], true
+}
+
+// EXIT_DIFFERENT is the exit status of diff when it finds differences, as
+// for diff(1).
+const EXIT_DIFFERENT = 1
+
+func xs_diff(script_name string, args []string) {
+	fs := flag.NewFlagSet(script_name, flag.ExitOnError)
+	with_perms := fs.Bool("perms", false, "also compare permissions")
+	interval := fs.Duration("interval", 0, "diff a live path against itself every `DURATION`")
+	count := fs.Int("count", 0, "stop after `N` intervals, 0 for no limit")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s [--perms] path|@snapshot path|@snapshot
+       %s [--perms] --interval DURATION [--count N] path
+
+An argument of the form @file is read as a snapshot written by
+"xenstore dump", any other argument is a live path. Exits with 1 when
+differences are found and 0 when there are none.
+`, script_name, script_name)
+		fs.PrintDefaults()
+		os.Exit(EXIT_USAGE)
+	}
+	parse_flags(fs, args)
+
+	warn := func(path string, err error) {
+		fmt.Fprintf(os.Stderr, "%s: %s: %v\n", script_name, path, err)
+	}
+
+	var xs xenstoreclient.XenStoreClient
+	load := func(name string) *snapshot {
+		if file, ok := snapshot_file(name); ok {
+			snap, err := load_snapshot(file)
+			if err != nil {
+				die("%s error: %v", script_name, err)
+			}
+			return snap
+		}
+		if xs == nil {
+			xs = new_xs()
+		}
+		return take_snapshot(xs, name, *with_perms, warn)
+	}
+
+	if *interval > 0 {
+		if _, ok := snapshot_file(fs.Arg(0)); fs.NArg() != 1 || ok {
+			fs.Usage()
+		}
+		last := load(fs.Arg(0))
+		differences := 0
+		for i := 0; *count == 0 || i < *count; i++ {
+			time.Sleep(*interval)
+			cur := load(fs.Arg(0))
+			fmt.Printf("--- %s\n", time.Now().Format(time.RFC3339))
+			differences += diff_snapshots(os.Stdout, last, cur, *with_perms)
+			last = cur
+		}
+		if differences != 0 {
+			os.Exit(EXIT_DIFFERENT)
+		}
+		return
+	}
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+	}
+	a := load(fs.Arg(0))
+	b := load(fs.Arg(1))
+	if diff_snapshots(os.Stdout, a, b, *with_perms) != 0 {
+		os.Exit(EXIT_DIFFERENT)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotFile(t *testing.T) {
+	for _, c := range []struct {
+		arg  string
+		file string
+		ok   bool
+	}{
+		{"/local/domain/0", "", false},
+		{"data", "", false},
+		{"snap.json", "", false},
+		{"@snap.json", "snap.json", true},
+		{"@/tmp/a@b", "/tmp/a@b", true},
+	} {
+		if file, ok := snapshot_file(c.arg); file != c.file || ok != c.ok {
+			t.Errorf("snapshot_file(%q) = %q, %v, expected %q, %v", c.arg, file, ok, c.file, c.ok)
+		}
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	a := &snapshot{Root: "/local/domain/1", Nodes: map[string]snapshot_node{
+		"":         {Value: ""},
+		"name":     {Value: "vm", Perms: []string{"n1"}},
+		"data":     {Value: ""},
+		"data/old": {Value: "gone"},
+		"data/bin": {Value: "AAE=", Encoding: "base64"},
+	}}
+	b := &snapshot{Root: "/local/domain/1", Nodes: map[string]snapshot_node{
+		"":         {Value: ""},
+		"name":     {Value: "vm", Perms: []string{"n1", "r0"}},
+		"data":     {Value: ""},
+		"data/new": {Value: "a\nb"},
+		"data/bin": {Value: "AAI=", Encoding: "base64"},
+	}}
+
+	for _, c := range []struct {
+		with_perms bool
+		expected   string
+	}{
+		{false, `~ /local/domain/1/data/bin: "\000\001" -> "\000\002"
++ /local/domain/1/data/new = "a\nb"
+- /local/domain/1/data/old = "gone"
+`},
+		{true, `~ /local/domain/1/data/bin: "\000\001" -> "\000\002"
++ /local/domain/1/data/new = "a\nb"
+- /local/domain/1/data/old = "gone"
+~ /local/domain/1/name: perms n1 -> n1 r0
+`},
+	} {
+		var out strings.Builder
+		count := diff_snapshots(&out, a, b, c.with_perms)
+		if out.String() != c.expected {
+			t.Errorf("diff_snapshots(with_perms=%v) wrote\n%s\nexpected\n%s", c.with_perms, out.String(), c.expected)
+		}
+		if expected := strings.Count(c.expected, "\n"); count != expected {
+			t.Errorf("diff_snapshots(with_perms=%v) = %d, expected %d", c.with_perms, count, expected)
+		}
+	}
+
+	var out strings.Builder
+	if count := diff_snapshots(&out, a, a, true); count != 0 || out.Len() != 0 {
+		t.Errorf("diff_snapshots(a, a) = %d, wrote %q", count, out.String())
+	}
+}
+
+func TestDiffExitStatus(t *testing.T) {
+	// run as the diff subcommand by the test below
+	if args := os.Getenv("XS_TEST_DIFF_ARGS"); args != "" {
+		xs_diff("diff", strings.Split(args, " "))
+		os.Exit(0)
+	}
+
+	dir := t.TempDir()
+	for name, text := range map[string]string{
+		"a.json": `{"root": "/local/domain/1", "nodes": {"": {"value": ""}, "name": {"value": "vm"}}}`,
+		"b.json": `{"root": "/local/domain/1", "nodes": {"": {"value": ""}, "name": {"value": "vm2"}}}`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := "@"+filepath.Join(dir, "a.json"), "@"+filepath.Join(dir, "b.json")
+
+	for _, c := range []struct {
+		args     string
+		expected int
+	}{
+		{a + " " + a, 0},
+		{a + " " + b, EXIT_DIFFERENT},
+		{"--perms " + b + " " + a, EXIT_DIFFERENT},
+	} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestDiffExitStatus$")
+		cmd.Env = append(os.Environ(), "XS_TEST_DIFF_ARGS="+c.args)
+		err := cmd.Run()
+		status := 0
+		var exit_err *exec.ExitError
+		if errors.As(err, &exit_err) {
+			status = exit_err.ExitCode()
+		} else if err != nil {
+			t.Fatalf("diff %s error: %v", c.args, err)
+		}
+		if status != c.expected {
+			t.Errorf("diff %s exited with %d, expected %d", c.args, status, c.expected)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// env_name turns the path of a node relative to the root into an environment
+// variable name, replacing characters not allowed in names by '_'.
+func env_name(rel string, prefix string, naming string) string {
+	var b strings.Builder
+	b.WriteString(prefix)
+	for i := 0; i < len(rel); i++ {
+		c := rel[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+			b.WriteByte(c)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	name := b.String()
+	switch naming {
+	case "upper":
+		name = strings.ToUpper(name)
+	case "lower":
+		name = strings.ToLower(name)
+	}
+	if len(name) > 0 && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+func shell_quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func xs_env(script_name string, args []string) {
+	fs := flag.NewFlagSet(script_name, flag.ExitOnError)
+	prefix := fs.String("prefix", "", "prepend `PREFIX` to every variable name")
+	naming := fs.String("naming", "upper", "variable name case, one of `upper`, lower or keep")
+	all := fs.Bool("all", false, "also export nodes which have children")
+	max_depth := fs.Int("max-depth", -1, "descend at most `N` levels below path")
+	export := fs.Bool("export", false, "print export lines for eval instead of running a command")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s [--prefix PREFIX] [--naming upper|lower|keep] [--all] [--max-depth N] path -- command [ args ... ]
+       %s [--prefix PREFIX] [--naming upper|lower|keep] [--all] [--max-depth N] --export path
+`, script_name, script_name)
+		fs.PrintDefaults()
+		os.Exit(EXIT_USAGE)
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 || (*naming != "upper" && *naming != "lower" && *naming != "keep") {
+		fs.Usage()
+	}
+	root := fs.Arg(0)
+	command := fs.Args()[1:]
+	if len(command) > 0 && command[0] == "--" {
+		command = command[1:]
+	} else if len(command) > 0 && is_option(command[0]) {
+		// an option misplaced after the path rather than a command, which
+		// needs "--" before it to start with '-'
+		fmt.Fprintf(fs.Output(), "%s: option %s must come before the arguments\n", fs.Name(), command[0])
+		fs.Usage()
+	}
+	if *export != (len(command) == 0) {
+		fs.Usage()
+	}
+
+	xs := new_xs()
+	vars := make(map[string]string)
+	sources := make(map[string]string)
+	walk_tree(xs, root, *max_depth, func(path string, depth int, err error) {
+		if err != nil {
+			die("%s error: %s: %v", script_name, path, err)
+		}
+		if path == root {
+			return
+		}
+		if !*all {
+			children, err := xs.List(path)
+			if err == nil && len(children) > 0 {
+				return
+			}
+		}
+		value, err := xs.Read(path)
+		if err != nil {
+			die("%s error: %s: %v", script_name, path, err)
+		}
+		name := env_name(rel_path(root, path), *prefix, *naming)
+		if other, ok := sources[name]; ok {
+			fmt.Fprintf(os.Stderr, "%s: %s and %s both map to %s\n", script_name, other, path, name)
+		}
+		sources[name] = path
+		vars[name] = value
+	})
+
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if *export {
+		for _, name := range names {
+			fmt.Printf("export %s=%s\n", name, shell_quote(vars[name]))
+		}
+		return
+	}
+
+	env := os.Environ()
+	for _, name := range names {
+		env = append(env, name+"="+vars[name])
+	}
+	bin, err := exec.LookPath(command[0])
+	if err != nil {
+		die("%s error: %v", script_name, err)
+	}
+	xs.Close()
+	err = syscall.Exec(bin, command, env)
+	die("%s error: %s: %v", script_name, bin, err)
+}
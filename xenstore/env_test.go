@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	for _, c := range []struct {
+		rel      string
+		prefix   string
+		naming   string
+		expected string
+	}{
+		{"name", "", "upper", "NAME"},
+		{"data/os-name", "", "upper", "DATA_OS_NAME"},
+		{"data/os-name", "", "lower", "data_os_name"},
+		{"Data/OsName", "", "keep", "Data_OsName"},
+		{"attr/eth0/ip", "xs_", "upper", "XS_ATTR_ETH0_IP"},
+		{"attr/eth0/ip", "XS_", "keep", "XS_attr_eth0_ip"},
+		{"0/name", "", "upper", "_0_NAME"},
+		{"0/name", "P", "upper", "P0_NAME"},
+		{"caf\xc3\xa9", "", "keep", "caf__"},
+		{"", "", "upper", ""},
+	} {
+		if got := env_name(c.rel, c.prefix, c.naming); got != c.expected {
+			t.Errorf("env_name(%q, %q, %q) = %q, expected %q", c.rel, c.prefix, c.naming, got, c.expected)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	xenstoreclient "github.com/xenserver/xe-guest-utilities/xenstoreclient"
+)
+
+// walk_func is called for every node visited by walk_tree. err is set when
+// the children of path could not be listed, in which case the walk carries
+// on with the siblings of path.
+type walk_func func(path string, depth int, err error)
+
+// walk_tree visits path and its descendants depth first, descending at most
+// max_depth levels below path, or without limit when max_depth is negative.
+func walk_tree(xs xenstoreclient.XenStoreClient, path string, max_depth int, fn walk_func) {
+	do_walk_tree(xs, path, 0, max_depth, fn)
+}
+
+func do_walk_tree(xs xenstoreclient.XenStoreClient, path string, depth int, max_depth int, fn walk_func) {
+	if max_depth >= 0 && depth >= max_depth {
+		fn(path, depth, nil)
+		return
+	}
+	children, err := xs.List(path)
+	fn(path, depth, err)
+	if err != nil {
+		return
+	}
+	for _, child := range children {
+		do_walk_tree(xs, join_path(path, child), depth+1, max_depth, fn)
+	}
+}
+
+type find_match struct {
+	Path  string  `json:"path"`
+	Value *string `json:"value,omitempty"`
+}
+
+func xs_find(script_name string, args []string) {
+	fs := flag.NewFlagSet(script_name, flag.ExitOnError)
+	key_re := fs.String("key", "", "only match nodes whose name matches `RE`")
+	value_re := fs.String("value", "", "only match nodes whose value matches `RE`")
+	max_depth := fs.Int("max-depth", -1, "descend at most `N` levels below path")
+	show_values := fs.Bool("values", false, "print values of matching nodes")
+	as_json := fs.Bool("json", false, "print matches as a JSON array")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [--key RE] [--value RE] [--max-depth N] [--values] [--json] path [ path ... ]\n", script_name)
+		fs.PrintDefaults()
+		os.Exit(EXIT_USAGE)
+	}
+	parse_flags(fs, args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+	}
+
+	var key_match, value_match *regexp.Regexp
+	var err error
+	if *key_re != "" {
+		if key_match, err = regexp.Compile(*key_re); err != nil {
+			die("%s error: --key: %v", script_name, err)
+		}
+	}
+	if *value_re != "" {
+		if value_match, err = regexp.Compile(*value_re); err != nil {
+			die("%s error: --value: %v", script_name, err)
+		}
+	}
+
+	xs := new_xs()
+	matches := make([]find_match, 0)
+	for _, root := range fs.Args() {
+		walk_tree(xs, root, *max_depth, func(path string, depth int, err error) {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s: %v\n", script_name, path, err)
+			}
+			if key_match != nil && !key_match.MatchString(base_name(path)) {
+				return
+			}
+			var value *string
+			if value_match != nil || *show_values {
+				v, err := xs.Read(path)
+				if err != nil {
+					if value_match != nil {
+						return
+					}
+				} else {
+					value = &v
+				}
+			}
+			if value_match != nil && !value_match.MatchString(*value) {
+				return
+			}
+			if !*show_values {
+				value = nil
+			}
+			if *as_json {
+				matches = append(matches, find_match{path, value})
+			} else {
+				print_match(os.Stdout, path, value)
+			}
+		})
+	}
+
+	if *as_json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(matches); err != nil {
+			die("%s error: %v", script_name, err)
+		}
+	}
+}
+
+func print_match(w io.Writer, path string, value *string) {
+	if value == nil {
+		fmt.Fprintln(w, path)
+	} else {
+		fmt.Fprintf(w, "%s = \"%s\"\n", path, sanitise_value(*value))
+	}
+}
+
+func base_name(path string) string {
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i] == '/' {
+			return path[i+1:]
+		}
+	}
+	return path
+}
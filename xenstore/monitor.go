@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type key_activity struct {
+	path     string
+	count    int
+	interval int // changes since the last report
+	last     time.Time
+	value    string
+}
+
+type monitor struct {
+	roots  []string
+	start  time.Time
+	total  int
+	keys   map[string]*key_activity
+	primed map[string]bool
+}
+
+func (m *monitor) record(path string, value string, now time.Time) {
+	// every watch fires once on registration, which is not a change
+	for _, root := range m.roots {
+		if path == root && !m.primed[root] {
+			m.primed[root] = true
+			return
+		}
+	}
+	k, ok := m.keys[path]
+	if !ok {
+		k = &key_activity{path: path}
+		m.keys[path] = k
+	}
+	k.count++
+	k.interval++
+	k.last = now
+	k.value = value
+	m.total++
+}
+
+func (m *monitor) sorted() []*key_activity {
+	keys := make([]*key_activity, 0, len(m.keys))
+	for _, k := range m.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].count != keys[j].count {
+			return keys[i].count > keys[j].count
+		}
+		return keys[i].path < keys[j].path
+	})
+	return keys
+}
+
+func truncate(s string, n int) string {
+	if n <= 3 {
+		return ""
+	}
+	if len(s) > n {
+		return s[:n-3] + "..."
+	}
+	return s
+}
+
+// draw_screen redraws a top-like table of the busiest keys.
+func (m *monitor) draw_screen(w io.Writer, now time.Time, rows int, width int) {
+	elapsed := now.Sub(m.start)
+	fmt.Fprint(w, "\x1b[H\x1b[2J")
+	fmt.Fprintf(w, "xenstore monitor %v  elapsed %s  changes %d (%.2f/s)  keys %d\n\n",
+		m.roots, elapsed.Truncate(time.Second), m.total, float64(m.total)/elapsed.Seconds(), len(m.keys))
+	fmt.Fprintf(w, "%7s %8s %6s  %s\n", "CHANGES", "PER MIN", "AGE", "PATH = VALUE")
+	for i, k := range m.sorted() {
+		if i >= rows {
+			break
+		}
+		rate := float64(k.count) / elapsed.Minutes()
+		line := fmt.Sprintf("%s = \"%s\"", k.path, sanitise_value(k.value))
+		fmt.Fprintf(w, "%7d %8.1f %5ds  %s\n", k.count, rate,
+			int(now.Sub(k.last).Seconds()), truncate(line, width-25))
+	}
+}
+
+// print_summary prints the keys which changed since the last summary.
+func (m *monitor) print_summary(w io.Writer, now time.Time) {
+	changed := 0
+	for _, k := range m.sorted() {
+		if k.interval == 0 {
+			continue
+		}
+		if changed == 0 {
+			fmt.Fprintf(w, "--- %s\n", now.Format(time.RFC3339))
+		}
+		changed++
+		fmt.Fprintf(w, "%5d %s = \"%s\"\n", k.interval, k.path, sanitise_value(k.value))
+		k.interval = 0
+	}
+}
+
+func xs_monitor(script_name string, args []string) {
+	fs := flag.NewFlagSet(script_name, flag.ExitOnError)
+	interval := fs.Duration("interval", 2*time.Second, "refresh every `DURATION`")
+	text := fs.Bool("text", false, "print periodic summaries instead of a full screen view")
+	rows := fs.Int("top", 0, "show the `N` busiest keys, default fits the terminal")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [--interval DURATION] [--text] [--top N] path [ path ... ]\n", script_name)
+		fs.PrintDefaults()
+		os.Exit(EXIT_USAGE)
+	}
+	parse_flags(fs, args)
+	if fs.NArg() == 0 || *interval <= 0 {
+		fs.Usage()
+	}
+
+	width, height := 80, 24
+	if ws, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ); err == nil {
+		width, height = int(ws.Col), int(ws.Row)
+	} else {
+		*text = true
+	}
+	if *rows <= 0 {
+		*rows = height - 4
+	}
+
+	// values are read on a second connection, as a read on the watching one
+	// can wait behind a full event queue
+	xs, reader := new_xs(), new_xs()
+	events, err := xs.Watch(fs.Args())
+	if err != nil {
+		die("%s error: %v", script_name, err)
+	}
+
+	m := &monitor{
+		roots:  fs.Args(),
+		start:  time.Now(),
+		keys:   make(map[string]*key_activity),
+		primed: make(map[string]bool),
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				die_status(EXIT_CONNECTION, "%s error: watch connection closed", script_name)
+			}
+			value, err := reader.Read(e.Path)
+			if err != nil {
+				value = fmt.Sprintf("<%v>", err)
+			}
+			m.record(e.Path, value, time.Now())
+		case now := <-ticker.C:
+			if *text {
+				m.print_summary(os.Stdout, now)
+			} else {
+				m.draw_screen(os.Stdout, now, *rows, width)
+			}
+		case <-interrupt:
+			xs.StopWatch()
+			if !*text {
+				fmt.Println()
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTruncate(t *testing.T) {
+	for _, c := range []struct {
+		s        string
+		n        int
+		expected string
+	}{
+		{"data/a", 10, "data/a"},
+		{"data/a", 6, "data/a"},
+		{"data/abc", 7, "data..."},
+		{"data/a", 3, ""},
+	} {
+		if got := truncate(c.s, c.n); got != c.expected {
+			t.Errorf("truncate(%q, %d) = %q, expected %q", c.s, c.n, got, c.expected)
+		}
+	}
+}
+
+func TestMonitorRecord(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := &monitor{roots: []string{"data"}, start: start,
+		keys: make(map[string]*key_activity), primed: make(map[string]bool)}
+
+	// the event fired when the watch is set is not counted, later ones on
+	// the root are
+	m.record("data", "", start)
+	m.record("data/b", "x", start)
+	m.record("data/a", "1", start)
+	m.record("data/a", "2\n", start)
+	m.record("data", "", start)
+	if m.total != 4 || len(m.keys) != 3 {
+		t.Errorf("recorded %d changes to %d keys, expected 4 to 3", m.total, len(m.keys))
+	}
+
+	var paths []string
+	for _, k := range m.sorted() {
+		paths = append(paths, k.path)
+	}
+	if got := strings.Join(paths, " "); got != "data/a data data/b" {
+		t.Errorf("sorted = %q, expected busiest first then by path", got)
+	}
+
+	var b strings.Builder
+	m.print_summary(&b, start)
+	expected := "--- 2024-01-02T03:04:05Z\n" +
+		"    2 data/a = \"2\\n\"\n" +
+		"    1 data = \"\"\n" +
+		"    1 data/b = \"x\"\n"
+	if b.String() != expected {
+		t.Errorf("print_summary = %q, expected %q", b.String(), expected)
+	}
+
+	// only keys changed since the last summary are printed
+	b.Reset()
+	m.print_summary(&b, start)
+	if b.String() != "" {
+		t.Errorf("print_summary without changes = %q, expected nothing", b.String())
+	}
+	m.record("data/b", "y", start.Add(time.Minute))
+	b.Reset()
+	m.print_summary(&b, start.Add(time.Minute))
+	if !strings.HasSuffix(b.String(), "\n    1 data/b = \"y\"\n") || strings.Count(b.String(), "\n") != 2 {
+		t.Errorf("print_summary after one change = %q", b.String())
+	}
+}
+
+func TestMonitorDrawScreen(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := &monitor{roots: []string{"data"}, start: start,
+		keys: make(map[string]*key_activity), primed: map[string]bool{"data": true}}
+	m.record("data/a", "1", start)
+	m.record("data/b", strings.Repeat("v", 100), start)
+	m.record("data/b", strings.Repeat("v", 100), start)
+
+	var b strings.Builder
+	m.draw_screen(&b, start.Add(time.Minute), 1, 60)
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("draw_screen with 1 row = %q, expected a header and one key", b.String())
+	}
+	if !strings.Contains(lines[0], "changes 3") {
+		t.Errorf("draw_screen header = %q, expected 3 changes", lines[0])
+	}
+	row := lines[3]
+	if !strings.Contains(row, "data/b = ") || !strings.HasSuffix(row, "...") || len(row) > 60 {
+		t.Errorf("draw_screen row = %q, expected the busiest key cut to the width", row)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	xenstoreclient "github.com/xenserver/xe-guest-utilities/xenstoreclient"
+	"golang.org/x/sys/unix"
+)
+
+const proxy_value_max = 64
+
+// describe_payload formats the NUL separated fields of a payload for the
+// log, shortening long values.
+func describe_payload(value []byte) string {
+	if len(value) == 0 {
+		return ""
+	}
+	fields := strings.Split(strings.TrimSuffix(string(value), "\x00"), "\x00")
+	for i, f := range fields {
+		if len(f) > proxy_value_max {
+			f = fmt.Sprintf("%s...(%d bytes)", f[:proxy_value_max], len(f))
+		}
+		fields[i] = strconv.Quote(f)
+	}
+	return strings.Join(fields, " ")
+}
+
+// peer_name identifies the process at the other end of a unix socket.
+func peer_name(conn net.Conn) string {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return "?"
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return "?"
+	}
+	var cred *unix.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return "?"
+	}
+	comm, _ := os.ReadFile(fmt.Sprintf("/proc/%d/comm", cred.Pid))
+	return fmt.Sprintf("%d(%s)", cred.Pid, strings.TrimSpace(string(comm)))
+}
+
+type proxy_request struct {
+	packet *xenstoreclient.Packet
+	start  time.Time
+}
+
+type proxy_conn struct {
+	id      int
+	peer    string
+	logger  *log.Logger
+	mutex   sync.Mutex
+	pending []proxy_request
+}
+
+// forward_requests copies requests from the client to xenstored, queueing
+// them to be matched with their replies, which xenstored sends in order.
+func (p *proxy_conn) forward_requests(client io.Reader, upstream io.Writer) error {
+	for {
+		req, err := read_request(client)
+		if err != nil {
+			return err
+		}
+		p.mutex.Lock()
+		p.pending = append(p.pending, proxy_request{req, time.Now()})
+		p.mutex.Unlock()
+		if err := req.Write(upstream); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *proxy_conn) forward_replies(upstream io.Reader, client io.Writer) error {
+	for {
+		resp, err := xenstoreclient.ReadRawPacket(upstream)
+		if err != nil {
+			return err
+		}
+		if resp.OpCode == xenstoreclient.XS_WATCH_EVENT {
+			p.logger.Printf("[%d] %s WATCH_EVENT %s", p.id, p.peer, describe_payload(resp.Value))
+		} else {
+			p.mutex.Lock()
+			var req proxy_request
+			if len(p.pending) > 0 {
+				req, p.pending = p.pending[0], p.pending[1:]
+			}
+			p.mutex.Unlock()
+			p.log_reply(req, resp)
+		}
+		if err := resp.Write(client); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *proxy_conn) log_reply(req proxy_request, resp *xenstoreclient.Packet) {
+	if req.packet == nil {
+		p.logger.Printf("[%d] %s unexpected %v %s", p.id, p.peer, resp.OpCode, describe_payload(resp.Value))
+		return
+	}
+	latency := time.Since(req.start)
+	result := "OK"
+	if resp.OpCode == xenstoreclient.XS_ERROR {
+		result = "error " + strings.TrimRight(string(resp.Value), "\x00")
+	} else if resp.OpCode != req.packet.OpCode {
+		result = "mismatched reply " + resp.OpCode.String()
+	} else {
+		switch resp.OpCode {
+		case xenstoreclient.XS_READ, xenstoreclient.XS_DIRECTORY, xenstoreclient.XS_DIRECTORY_PART,
+			xenstoreclient.XS_GET_PERMS, xenstoreclient.XS_TRANSACTION_START, xenstoreclient.XS_GET_DOMAIN_PATH:
+			result = "-> " + describe_payload(resp.Value)
+		}
+	}
+	p.logger.Printf("[%d] %s %v tx=%d %s %s (%v)", p.id, p.peer, req.packet.OpCode, req.packet.TxID,
+		describe_payload(req.packet.Value), result, latency)
+}
+
+func proxy_client(id int, client net.Conn, upstream_path string, logger *log.Logger) {
+	defer client.Close()
+	p := &proxy_conn{id: id, peer: peer_name(client), logger: logger}
+
+	upstream, err := xenstoreclient.OpenDevice(upstream_path)
+	if err != nil {
+		logger.Printf("[%d] %s cannot open %s: %v", id, p.peer, upstream_path, err)
+		return
+	}
+	defer upstream.Close()
+	logger.Printf("[%d] %s connected", id, p.peer)
+
+	done := make(chan error, 2)
+	go func() { done <- p.forward_requests(client, upstream) }()
+	go func() { done <- p.forward_replies(upstream, client) }()
+	if err := <-done; err != nil && err != io.EOF {
+		logger.Printf("[%d] %s closed: %v", id, p.peer, err)
+	} else {
+		logger.Printf("[%d] %s disconnected", id, p.peer)
+	}
+}
+
+func xs_proxy(script_name string, args []string) {
+	fs := flag.NewFlagSet(script_name, flag.ExitOnError)
+	listen := fs.String("listen", "", "accept clients on the unix socket `PATH`")
+	upstream := fs.String("upstream", "", "xenbus device or xenstored socket `PATH` to forward to")
+	log_file := fs.String("log", "", "append the log to `FILE` instead of stderr")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s --listen PATH --upstream PATH [--log FILE]
+
+Forwards clients connecting to PATH to xenstored, logging every request with
+the client process, the reply and its latency. Point clients at the proxy by
+setting XENSTORED_PATH=PATH.
+`, script_name)
+		fs.PrintDefaults()
+		os.Exit(EXIT_USAGE)
+	}
+	parse_flags(fs, args)
+	if fs.NArg() != 0 || *listen == "" || *upstream == "" {
+		fs.Usage()
+	}
+
+	out := io.Writer(os.Stderr)
+	if *log_file != "" {
+		f, err := os.OpenFile(*log_file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			die("%s error: %v", script_name, err)
+		}
+		defer f.Close()
+		out = f
+	}
+	logger := log.New(out, "", log.LstdFlags|log.Lmicroseconds)
+
+	l, err := listen_unix(*listen)
+	if err != nil {
+		die("%s error: %v", script_name, err)
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		l.Close()
+	}()
+
+	for id := 1; ; id++ {
+		conn, err := l.Accept()
+		if err != nil {
+			break
+		}
+		go proxy_client(id, conn, *upstream, logger)
+	}
+	os.Remove(*listen)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	xenstoreclient "github.com/xenserver/xe-guest-utilities/xenstoreclient"
+)
+
+func TestDescribePayload(t *testing.T) {
+	long := strings.Repeat("x", proxy_value_max+1)
+	for _, c := range []struct {
+		value    string
+		expected string
+	}{
+		{"", ""},
+		{"data/a\x00", `"data/a"`},
+		{"data/a\x00value", `"data/a" "value"`},
+		{"data/a\x00tab\there", `"data/a" "tab\there"`},
+		{long, `"` + long[:proxy_value_max] + `...(65 bytes)"`},
+	} {
+		if got := describe_payload([]byte(c.value)); got != c.expected {
+			t.Errorf("describe_payload(%q) = %q, expected %q", c.value, got, c.expected)
+		}
+	}
+}
+
+func TestProxyClient(t *testing.T) {
+	xs := test_xs(t)
+	var logged bytes.Buffer
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		proxy_client(1, server, os.Getenv("XENSTORED_PATH"), log.New(&logged, "", 0))
+		close(done)
+	}()
+
+	for _, r := range []struct {
+		op       xenstoreclient.Operation
+		value    string
+		expected *xenstoreclient.Packet
+	}{
+		{xenstoreclient.XS_WRITE, "data/a\x00value", &xenstoreclient.Packet{OpCode: xenstoreclient.XS_WRITE, Req: 1, Length: 3, Value: []byte("OK\x00")}},
+		{xenstoreclient.XS_READ, "data/a\x00", &xenstoreclient.Packet{OpCode: xenstoreclient.XS_READ, Req: 2, Length: 5, Value: []byte("value")}},
+		{xenstoreclient.XS_READ, "data/b\x00", &xenstoreclient.Packet{OpCode: xenstoreclient.XS_ERROR, Req: 3, Length: 7, Value: []byte("ENOENT\x00")}},
+	} {
+		req := &xenstoreclient.Packet{OpCode: r.op, Req: r.expected.Req, Length: uint32(len(r.value)), Value: []byte(r.value)}
+		if err := req.Write(client); err != nil {
+			t.Fatalf("%v write error: %v", r.op, err)
+		}
+		resp, err := xenstoreclient.ReadRawPacket(client)
+		if err != nil {
+			t.Fatalf("%v reply error: %v", r.op, err)
+		}
+		if resp.OpCode != r.expected.OpCode || resp.Req != r.expected.Req || string(resp.Value) != string(r.expected.Value) {
+			t.Errorf("%v %q reply = %+v, expected %+v", r.op, r.value, resp, r.expected)
+		}
+	}
+	client.Close()
+	<-done
+
+	if value, err := xs.Read("data/a"); err != nil || value != "value" {
+		t.Errorf("data/a = %q, %v, expected the value written through the proxy", value, err)
+	}
+	for _, expected := range []string{
+		"[1] ? connected",
+		`WRITE tx=0 "data/a" "value" OK`,
+		`READ tx=0 "data/a" -> "value"`,
+		`READ tx=0 "data/b" error ENOENT`,
+		"[1] ? disconnected",
+	} {
+		if !strings.Contains(logged.String(), expected) {
+			t.Errorf("proxy log is missing %q:\n%s", expected, logged.String())
+		}
+	}
+}
@@ -0,0 +1,698 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	xenstoreclient "github.com/xenserver/xe-guest-utilities/xenstoreclient"
+)
+
+// xs_error is the name of an errno sent back to the client in an XS_ERROR
+// reply.
+type xs_error string
+
+func (e xs_error) Error() string {
+	return string(e)
+}
+
+const (
+	ENOENT xs_error = "ENOENT"
+	EINVAL xs_error = "EINVAL"
+	EAGAIN xs_error = "EAGAIN"
+	E2BIG  xs_error = "E2BIG"
+	ENOSYS xs_error = "ENOSYS"
+	EEXIST xs_error = "EEXIST"
+)
+
+type xs_node struct {
+	value    []byte
+	perms    []xenstoreclient.Permission
+	children []string
+	gen      uint64
+}
+
+func (n *xs_node) clone() *xs_node {
+	c := *n
+	c.perms = append([]xenstoreclient.Permission(nil), n.perms...)
+	c.children = append([]string(nil), n.children...)
+	return &c
+}
+
+// xs_tree holds every node keyed by its absolute path.
+type xs_tree map[string]*xs_node
+
+func (t xs_tree) clone() xs_tree {
+	c := make(xs_tree, len(t))
+	for p, n := range t {
+		c[p] = n.clone()
+	}
+	return c
+}
+
+func parent_path(path string) string {
+	slash := strings.LastIndex(path, "/")
+	if slash <= 0 {
+		return "/"
+	}
+	return path[:slash]
+}
+
+// xs_view applies operations to a tree, remembering which nodes were looked
+// at and changed so that transactions can detect conflicts and watches can
+// be fired.
+type xs_view struct {
+	tree     xs_tree
+	gen      uint64
+	accessed map[string]bool
+	modified map[string]bool
+	events   []xs_event
+}
+
+type xs_event struct {
+	path    string
+	removed bool
+}
+
+func new_view(tree xs_tree, gen uint64) *xs_view {
+	return &xs_view{tree: tree, gen: gen, accessed: make(map[string]bool), modified: make(map[string]bool)}
+}
+
+func (v *xs_view) get(path string) *xs_node {
+	v.accessed[path] = true
+	return v.tree[path]
+}
+
+func (v *xs_view) touch(path string, n *xs_node) {
+	v.accessed[path] = true
+	v.modified[path] = true
+	n.gen = v.gen
+}
+
+func (v *xs_view) create(path string) *xs_node {
+	if n := v.get(path); n != nil {
+		return n
+	}
+	parent := v.create(parent_path(path))
+	parent.children = append(parent.children, path[strings.LastIndex(path, "/")+1:])
+	v.touch(parent_path(path), parent)
+	n := &xs_node{perms: append([]xenstoreclient.Permission(nil), parent.perms...)}
+	v.tree[path] = n
+	v.touch(path, n)
+	return n
+}
+
+func (v *xs_view) write(path string, value []byte) {
+	n := v.create(path)
+	n.value = value
+	v.touch(path, n)
+	v.events = append(v.events, xs_event{path, false})
+}
+
+func (v *xs_view) mkdir(path string) {
+	if v.get(path) == nil {
+		v.create(path)
+		v.events = append(v.events, xs_event{path, false})
+	}
+}
+
+func (v *xs_view) rm(path string) error {
+	if path == "/" {
+		return EINVAL
+	}
+	n := v.get(path)
+	if n == nil {
+		// removing a missing node is fine as long as its parent exists
+		if v.get(parent_path(path)) == nil {
+			return ENOENT
+		}
+		return nil
+	}
+	v.rm_subtree(path, n)
+	parent := v.get(parent_path(path))
+	name := path[strings.LastIndex(path, "/")+1:]
+	for i, child := range parent.children {
+		if child == name {
+			parent.children = append(parent.children[:i], parent.children[i+1:]...)
+			break
+		}
+	}
+	v.touch(parent_path(path), parent)
+	v.events = append(v.events, xs_event{path, true})
+	return nil
+}
+
+func (v *xs_view) rm_subtree(path string, n *xs_node) {
+	for _, child := range n.children {
+		child_path := join_path(path, child)
+		v.rm_subtree(child_path, v.tree[child_path])
+	}
+	delete(v.tree, path)
+	v.accessed[path] = true
+	v.modified[path] = true
+}
+
+type server_watch struct {
+	path     string
+	token    string
+	relative bool
+}
+
+type xs_transaction struct {
+	id    uint32
+	start uint64
+	view  *xs_view
+}
+
+type xs_conn struct {
+	conn    net.Conn
+	watches []server_watch
+	txs     map[uint32]*xs_transaction
+	// replies and watch events wait in queue for write_loop, so that they
+	// reach the client in order without blocking the server on it
+	qmutex sync.Mutex
+	queue  []*xenstoreclient.Packet
+	ready  chan struct{}
+}
+
+func new_conn(conn net.Conn) *xs_conn {
+	return &xs_conn{conn: conn, txs: make(map[uint32]*xs_transaction), ready: make(chan struct{}, 1)}
+}
+
+// send queues a packet for the client, after any queued earlier.
+func (c *xs_conn) send(p *xenstoreclient.Packet) {
+	c.qmutex.Lock()
+	c.queue = append(c.queue, p)
+	c.qmutex.Unlock()
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+// write_loop writes the queued packets in order until ready is closed,
+// closing the connection if a write fails.
+func (c *xs_conn) write_loop() {
+	for range c.ready {
+		c.qmutex.Lock()
+		queue := c.queue
+		c.queue = nil
+		c.qmutex.Unlock()
+		for _, p := range queue {
+			if err := p.Write(c.conn); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+type xs_server struct {
+	mutex       sync.Mutex
+	tree        xs_tree
+	gen         uint64
+	changed     map[string]uint64 // generation each path was last created, changed or removed
+	next_tx     uint32
+	conns       map[*xs_conn]bool
+	domain_path string
+	logger      *log.Logger
+}
+
+func new_server(domid uint) *xs_server {
+	s := &xs_server{
+		tree:        xs_tree{"/": {perms: []xenstoreclient.Permission{{Id: 0, Pe: xenstoreclient.PERM_NONE}}}},
+		changed:     make(map[string]uint64),
+		next_tx:     1,
+		conns:       make(map[*xs_conn]bool),
+		domain_path: fmt.Sprintf("/local/domain/%d", domid),
+	}
+	v := new_view(s.tree, 0)
+	v.write(s.domain_path+"/domid", []byte(strconv.FormatUint(uint64(domid), 10)))
+	return s
+}
+
+func (s *xs_server) load(snap *snapshot) error {
+	v := new_view(s.tree, 0)
+	paths := make([]string, 0, len(snap.Nodes))
+	for p := range snap.Nodes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		path := snap.Root
+		if p != "" {
+			path = join_path(snap.Root, p)
+		}
+		path, err := s.resolve(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		node := snap.Nodes[p]
+		value, err := node.value()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		v.write(path, []byte(value))
+		if node.Perms != nil {
+			perms, err := parse_perms(node.Perms)
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			v.get(path).perms = perms
+		}
+	}
+	return nil
+}
+
+func valid_path(path string) bool {
+	if path == "/" {
+		return true
+	}
+	if len(path) == 0 || len(path) > XENSTORE_ABS_PATH_MAX || path[0] != '/' ||
+		strings.HasSuffix(path, "/") || strings.Contains(path, "//") {
+		return false
+	}
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '/' || c == '-' || c == '_' || c == '@') {
+			return false
+		}
+	}
+	return true
+}
+
+// resolve makes path absolute, relative paths being below the domain path.
+func (s *xs_server) resolve(path string) (string, error) {
+	if !strings.HasPrefix(path, "/") {
+		path = s.domain_path + "/" + path
+	}
+	if !valid_path(path) {
+		return "", EINVAL
+	}
+	return path, nil
+}
+
+// fire sends a watch event to every watch covering one of the events.
+func (s *xs_server) fire(events []xs_event) {
+	for c := range s.conns {
+		for _, w := range c.watches {
+			for _, e := range events {
+				path := ""
+				switch {
+				case strings.HasPrefix(w.path, "@"):
+				case e.path == w.path || strings.HasPrefix(e.path, strings.TrimSuffix(w.path, "/")+"/"):
+					path = e.path
+				case e.removed && strings.HasPrefix(w.path, e.path+"/"):
+					path = w.path
+				}
+				if path != "" {
+					s.send_event(c, w, path)
+				}
+			}
+		}
+	}
+}
+
+func (s *xs_server) send_event(c *xs_conn, w server_watch, path string) {
+	if w.relative {
+		path = strings.TrimPrefix(path, s.domain_path+"/")
+	}
+	v := []byte(path + "\x00" + w.token + "\x00")
+	c.send(&xenstoreclient.Packet{
+		OpCode: xenstoreclient.XS_WATCH_EVENT,
+		Length: uint32(len(v)),
+		Value:  v,
+	})
+}
+
+// commit_view records the changes made through v, stamping them with a new
+// generation, and fires the watches.
+func (s *xs_server) commit_view(v *xs_view) {
+	if len(v.modified) == 0 {
+		return
+	}
+	s.gen++
+	for p := range v.modified {
+		s.changed[p] = s.gen
+		if n := s.tree[p]; n != nil {
+			n.gen = s.gen
+		}
+	}
+	s.fire(v.events)
+}
+
+func (s *xs_server) end_transaction(c *xs_conn, tx *xs_transaction, commit bool) error {
+	delete(c.txs, tx.id)
+	if !commit {
+		return nil
+	}
+	for p := range tx.view.accessed {
+		if s.changed[p] > tx.start {
+			return EAGAIN
+		}
+	}
+	for p := range tx.view.modified {
+		if n := tx.view.tree[p]; n != nil {
+			s.tree[p] = n.clone()
+		} else {
+			delete(s.tree, p)
+		}
+	}
+	tx.view.tree = s.tree
+	s.commit_view(tx.view)
+	return nil
+}
+
+func split_args(value []byte) []string {
+	return strings.Split(strings.TrimSuffix(string(value), "\x00"), "\x00")
+}
+
+func ok_reply() []byte {
+	return []byte("OK\x00")
+}
+
+// handle carries out a single request, returning the reply payload.
+func (s *xs_server) handle(c *xs_conn, req *xenstoreclient.Packet) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if req.Length > xenstoreclient.XENSTORE_PAYLOAD_MAX {
+		return nil, E2BIG
+	}
+
+	var v *xs_view
+	var tx *xs_transaction
+	if req.TxID != 0 {
+		if tx = c.txs[req.TxID]; tx == nil {
+			return nil, ENOENT
+		}
+		v = tx.view
+	} else {
+		v = new_view(s.tree, s.gen+1)
+	}
+
+	args := split_args(req.Value)
+	path := ""
+	if len(args) > 0 && req.OpCode != xenstoreclient.XS_WATCH && req.OpCode != xenstoreclient.XS_UNWATCH {
+		var err error
+		if path, err = s.resolve(args[0]); err != nil &&
+			req.OpCode != xenstoreclient.XS_GET_DOMAIN_PATH &&
+			req.OpCode != xenstoreclient.XS_TRANSACTION_START &&
+			req.OpCode != xenstoreclient.XS_TRANSACTION_END &&
+			req.OpCode != xenstoreclient.XS_CONTROL &&
+			req.OpCode != xenstoreclient.XS_RESET_WATCHES &&
+			req.OpCode != xenstoreclient.XS_IS_DOMAIN_INTRODUCED {
+			return nil, err
+		}
+	}
+
+	switch req.OpCode {
+	case xenstoreclient.XS_READ:
+		n := v.get(path)
+		if n == nil {
+			return nil, ENOENT
+		}
+		return n.value, nil
+
+	case xenstoreclient.XS_WRITE:
+		nul := bytes.IndexByte(req.Value, 0)
+		if nul < 0 {
+			return nil, EINVAL
+		}
+		v.write(path, append([]byte(nil), req.Value[nul+1:]...))
+
+	case xenstoreclient.XS_MKDIR:
+		v.mkdir(path)
+
+	case xenstoreclient.XS_RM:
+		if err := v.rm(path); err != nil {
+			return nil, err
+		}
+
+	case xenstoreclient.XS_DIRECTORY, xenstoreclient.XS_DIRECTORY_PART:
+		n := v.get(path)
+		if n == nil {
+			return nil, ENOENT
+		}
+		var b bytes.Buffer
+		for _, child := range n.children {
+			b.WriteString(child + "\x00")
+		}
+		if req.OpCode == xenstoreclient.XS_DIRECTORY {
+			if b.Len() > xenstoreclient.XENSTORE_PAYLOAD_MAX {
+				return nil, E2BIG
+			}
+			return b.Bytes(), nil
+		}
+		if len(args) < 2 {
+			return nil, EINVAL
+		}
+		offset, err := strconv.Atoi(args[1])
+		if err != nil || offset < 0 || offset > b.Len() {
+			return nil, EINVAL
+		}
+		gen := []byte(strconv.FormatUint(n.gen, 10) + "\x00")
+		part := b.Bytes()[offset:]
+		if room := xenstoreclient.XENSTORE_PAYLOAD_MAX - len(gen) - 1; len(part) > room {
+			// end the part on a whole name
+			cut := bytes.LastIndexByte(part[:room], 0)
+			return append(gen, part[:cut+1]...), nil
+		}
+		return append(append(gen, part...), 0), nil
+
+	case xenstoreclient.XS_GET_PERMS:
+		n := v.get(path)
+		if n == nil {
+			return nil, ENOENT
+		}
+		var b bytes.Buffer
+		for _, p := range n.perms {
+			b.WriteString(p.ToStr() + "\x00")
+		}
+		return b.Bytes(), nil
+
+	case xenstoreclient.XS_SET_PERMS:
+		n := v.get(path)
+		if n == nil {
+			return nil, ENOENT
+		}
+		perms, err := parse_perms(args[1:])
+		if err != nil || len(perms) == 0 {
+			return nil, EINVAL
+		}
+		n.perms = perms
+		v.touch(path, n)
+		v.events = append(v.events, xs_event{path, false})
+
+	case xenstoreclient.XS_WATCH:
+		if len(args) < 2 {
+			return nil, EINVAL
+		}
+		w := server_watch{path: args[0], token: args[1]}
+		if !strings.HasPrefix(w.path, "@") {
+			var err error
+			w.relative = !strings.HasPrefix(w.path, "/")
+			if w.path, err = s.resolve(w.path); err != nil {
+				return nil, err
+			}
+		}
+		for _, existing := range c.watches {
+			if existing.path == w.path && existing.token == w.token {
+				return nil, EEXIST
+			}
+		}
+		c.watches = append(c.watches, w)
+		// a new watch always fires once
+		s.send_event(c, w, w.path)
+
+	case xenstoreclient.XS_UNWATCH:
+		if len(args) < 2 {
+			return nil, EINVAL
+		}
+		watch_path := args[0]
+		if !strings.HasPrefix(watch_path, "@") {
+			var err error
+			if watch_path, err = s.resolve(watch_path); err != nil {
+				return nil, err
+			}
+		}
+		for i, w := range c.watches {
+			if w.path == watch_path && w.token == args[1] {
+				c.watches = append(c.watches[:i], c.watches[i+1:]...)
+				return ok_reply(), nil
+			}
+		}
+		return nil, ENOENT
+
+	case xenstoreclient.XS_RESET_WATCHES:
+		c.watches = nil
+
+	case xenstoreclient.XS_TRANSACTION_START:
+		if tx != nil {
+			return nil, EINVAL
+		}
+		tx = &xs_transaction{id: s.next_tx, start: s.gen}
+		tx.view = new_view(s.tree.clone(), s.gen+1)
+		s.next_tx++
+		c.txs[tx.id] = tx
+		return []byte(strconv.FormatUint(uint64(tx.id), 10) + "\x00"), nil
+
+	case xenstoreclient.XS_TRANSACTION_END:
+		if tx == nil || len(args) < 1 || (args[0] != "T" && args[0] != "F") {
+			return nil, EINVAL
+		}
+		if err := s.end_transaction(c, tx, args[0] == "T"); err != nil {
+			return nil, err
+		}
+		return ok_reply(), nil
+
+	case xenstoreclient.XS_GET_DOMAIN_PATH:
+		domid, err := strconv.ParseUint(args[0], 10, 16)
+		if err != nil {
+			return nil, EINVAL
+		}
+		return []byte(fmt.Sprintf("/local/domain/%d\x00", domid)), nil
+
+	case xenstoreclient.XS_IS_DOMAIN_INTRODUCED:
+		return []byte("T\x00"), nil
+
+	default:
+		return nil, ENOSYS
+	}
+
+	if tx == nil {
+		s.commit_view(v)
+	}
+	return ok_reply(), nil
+}
+
+// read_request reads a request from a client, refusing one whose payload
+// exceeds the protocol limit from its header, before reading the payload.
+func read_request(r io.Reader) (*xenstoreclient.Packet, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(header[12:]) > xenstoreclient.XENSTORE_PAYLOAD_MAX {
+		return nil, E2BIG
+	}
+	return xenstoreclient.ReadRawPacket(io.MultiReader(bytes.NewReader(header[:]), r))
+}
+
+func (s *xs_server) serve_conn(conn net.Conn) {
+	c := new_conn(conn)
+	s.mutex.Lock()
+	s.conns[c] = true
+	s.mutex.Unlock()
+	go c.write_loop()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, c)
+		s.mutex.Unlock()
+		// nothing sends to c once it is out of conns
+		close(c.ready)
+		conn.Close()
+	}()
+
+	for {
+		req, err := read_request(conn)
+		if err != nil {
+			if err != io.EOF && s.logger != nil {
+				s.logger.Printf("closing connection: %v", err)
+			}
+			return
+		}
+		value, err := s.handle(c, req)
+		resp := &xenstoreclient.Packet{OpCode: req.OpCode, Req: req.Req, TxID: req.TxID}
+		if err != nil {
+			resp.OpCode = xenstoreclient.XS_ERROR
+			value = []byte(err.Error() + "\x00")
+		}
+		resp.Length = uint32(len(value))
+		resp.Value = value
+		if s.logger != nil {
+			args := strings.Join(split_args(req.Value), " ")
+			if err != nil {
+				s.logger.Printf("%v tx %d %q: %v", req.OpCode, req.TxID, args, err)
+			} else {
+				s.logger.Printf("%v tx %d %q", req.OpCode, req.TxID, args)
+			}
+		}
+		c.send(resp)
+	}
+}
+
+func listen_unix(socket_path string) (net.Listener, error) {
+	// replace a stale socket left by an earlier run
+	if fi, err := os.Stat(socket_path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(socket_path)
+	}
+	return net.Listen("unix", socket_path)
+}
+
+func xs_serve(script_name string, args []string) {
+	fs := flag.NewFlagSet(script_name, flag.ExitOnError)
+	socket_path := fs.String("socket", "", "listen on the unix socket `PATH`")
+	load := fs.String("load", "", "populate the store from a snapshot `FILE` written by \"xenstore dump\"")
+	domid := fs.Uint("domid", 1, "domain `ID` clients act as, relative paths being below its domain path")
+	verbose := fs.Bool("verbose", false, "log every request to stderr")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s --socket PATH [--load FILE] [--domid ID] [--verbose]
+
+Runs an in-memory xenstored for development, clients reach it by setting
+XENSTORED_PATH=PATH. Permissions are stored but not enforced.
+`, script_name)
+		fs.PrintDefaults()
+		os.Exit(EXIT_USAGE)
+	}
+	parse_flags(fs, args)
+	if fs.NArg() != 0 || *socket_path == "" {
+		fs.Usage()
+	}
+
+	s := new_server(*domid)
+	if *verbose {
+		s.logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	if *load != "" {
+		snap, err := load_snapshot(*load)
+		if err != nil {
+			die("%s error: %v", script_name, err)
+		}
+		if err := s.load(snap); err != nil {
+			die("%s error: %s: %v", script_name, *load, err)
+		}
+	}
+
+	l, err := listen_unix(*socket_path)
+	if err != nil {
+		die("%s error: %v", script_name, err)
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			break
+		}
+		go s.serve_conn(conn)
+	}
+	os.Remove(*socket_path)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	xenstoreclient "github.com/xenserver/xe-guest-utilities/xenstoreclient"
+)
+
+// test_xs starts an in-memory server for domain 1 and returns a client
+// connected to it, both going away at the end of the test.
+func test_xs(t *testing.T) xenstoreclient.XenStoreClient {
+	s := new_server(1)
+	socket := filepath.Join(t.TempDir(), "socket")
+	l, err := listen_unix(socket)
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve_conn(conn)
+		}
+	}()
+	t.Setenv("XENSTORED_PATH", socket)
+	xs, err := xenstoreclient.NewXenstore(0)
+	if err != nil {
+		t.Fatalf("NewXenstore error: %v", err)
+	}
+	t.Cleanup(func() { xs.Close() })
+	return xs
+}
+
+// request runs a request on c, the arguments being joined by NUL and, but
+// for XS_WRITE, ended by one.
+func request(s *xs_server, c *xs_conn, op xenstoreclient.Operation, tx uint32, args ...string) (string, error) {
+	value := strings.Join(args, "\x00")
+	if op != xenstoreclient.XS_WRITE {
+		value += "\x00"
+	}
+	req := &xenstoreclient.Packet{OpCode: op, TxID: tx, Length: uint32(len(value)), Value: []byte(value)}
+	reply, err := s.handle(c, req)
+	return string(reply), err
+}
+
+func TestServerRequests(t *testing.T) {
+	s := new_server(1)
+	c := new_conn(nil)
+
+	for _, r := range []struct {
+		op       xenstoreclient.Operation
+		args     []string
+		expected string
+		err      error
+	}{
+		{xenstoreclient.XS_READ, []string{"domid"}, "1", nil},
+		{xenstoreclient.XS_READ, []string{"/local/domain/1/domid"}, "1", nil},
+		{xenstoreclient.XS_READ, []string{"data/missing"}, "", ENOENT},
+		{xenstoreclient.XS_WRITE, []string{"data/a", "x\x00y"}, "OK\x00", nil},
+		{xenstoreclient.XS_READ, []string{"data/a"}, "x\x00y", nil},
+		{xenstoreclient.XS_READ, []string{"data"}, "", nil},
+		{xenstoreclient.XS_MKDIR, []string{"data/b"}, "OK\x00", nil},
+		{xenstoreclient.XS_DIRECTORY, []string{"data"}, "a\x00b\x00", nil},
+		{xenstoreclient.XS_DIRECTORY, []string{"data/none"}, "", ENOENT},
+		{xenstoreclient.XS_GET_PERMS, []string{"data/a"}, "n0\x00", nil},
+		{xenstoreclient.XS_SET_PERMS, []string{"data/a", "b1", "r0"}, "OK\x00", nil},
+		{xenstoreclient.XS_GET_PERMS, []string{"data/a"}, "b1\x00r0\x00", nil},
+		{xenstoreclient.XS_SET_PERMS, []string{"data/a", "q1"}, "", EINVAL},
+		{xenstoreclient.XS_RM, []string{"data/a"}, "OK\x00", nil},
+		{xenstoreclient.XS_RM, []string{"data/a"}, "OK\x00", nil},
+		{xenstoreclient.XS_RM, []string{"data/none/a"}, "", ENOENT},
+		{xenstoreclient.XS_RM, []string{"/"}, "", EINVAL},
+		{xenstoreclient.XS_DIRECTORY, []string{"data"}, "b\x00", nil},
+		{xenstoreclient.XS_READ, []string{"/local//domain"}, "", EINVAL},
+		{xenstoreclient.XS_READ, []string{"data/a b"}, "", EINVAL},
+		{xenstoreclient.XS_GET_DOMAIN_PATH, []string{"7"}, "/local/domain/7\x00", nil},
+		{xenstoreclient.XS_GET_DOMAIN_PATH, []string{"x"}, "", EINVAL},
+		{xenstoreclient.XS_TRANSACTION_END, []string{"T"}, "", EINVAL},
+		{xenstoreclient.XS_INTRODUCE, []string{"2"}, "", ENOSYS},
+	} {
+		reply, err := request(s, c, r.op, 0, r.args...)
+		if reply != r.expected || err != r.err {
+			t.Errorf("%v %q = %q, %v, expected %q, %v", r.op, r.args, reply, err, r.expected, r.err)
+		}
+	}
+}
+
+func TestServerTransactions(t *testing.T) {
+	s := new_server(1)
+	c := new_conn(nil)
+	request(s, c, xenstoreclient.XS_WRITE, 0, "data/a", "1")
+	request(s, c, xenstoreclient.XS_WRITE, 0, "data/b", "1")
+
+	start := func() uint32 {
+		reply, err := request(s, c, xenstoreclient.XS_TRANSACTION_START, 0, "")
+		if err != nil {
+			t.Fatalf("transaction start error: %v", err)
+		}
+		var tx uint32
+		fmt.Sscan(strings.TrimSuffix(reply, "\x00"), &tx)
+		return tx
+	}
+	read := func(tx uint32, path string) string {
+		reply, _ := request(s, c, xenstoreclient.XS_READ, tx, path)
+		return reply
+	}
+
+	// changes are only seen outside once committed
+	tx := start()
+	request(s, c, xenstoreclient.XS_WRITE, tx, "data/a", "2")
+	if v := read(tx, "data/a"); v != "2" {
+		t.Errorf("read in transaction = %q, expected %q", v, "2")
+	}
+	if v := read(0, "data/a"); v != "1" {
+		t.Errorf("read outside transaction = %q, expected %q", v, "1")
+	}
+	if _, err := request(s, c, xenstoreclient.XS_TRANSACTION_END, tx, "T"); err != nil {
+		t.Errorf("commit error: %v", err)
+	}
+	if v := read(0, "data/a"); v != "2" {
+		t.Errorf("read after commit = %q, expected %q", v, "2")
+	}
+	if _, err := request(s, c, xenstoreclient.XS_READ, tx, "data/a"); err != ENOENT {
+		t.Errorf("read in ended transaction error = %v, expected %v", err, ENOENT)
+	}
+
+	// aborted changes are dropped
+	tx = start()
+	request(s, c, xenstoreclient.XS_WRITE, tx, "data/a", "3")
+	request(s, c, xenstoreclient.XS_TRANSACTION_END, tx, "F")
+	if v := read(0, "data/a"); v != "2" {
+		t.Errorf("read after abort = %q, expected %q", v, "2")
+	}
+
+	// a transaction fails with EAGAIN when a node it accessed changed
+	tx = start()
+	read(tx, "data/a")
+	request(s, c, xenstoreclient.XS_WRITE, tx, "data/b", "4")
+	request(s, c, xenstoreclient.XS_WRITE, 0, "data/a", "5")
+	if _, err := request(s, c, xenstoreclient.XS_TRANSACTION_END, tx, "T"); err != EAGAIN {
+		t.Errorf("conflicting commit error = %v, expected %v", err, EAGAIN)
+	}
+	if v := read(0, "data/b"); v != "1" {
+		t.Errorf("read after failed commit = %q, expected %q", v, "1")
+	}
+	if len(c.txs) != 0 {
+		t.Errorf("failed transaction is still open")
+	}
+
+	// but not when unrelated nodes changed
+	tx = start()
+	read(tx, "data/a")
+	request(s, c, xenstoreclient.XS_WRITE, tx, "data/b", "6")
+	request(s, c, xenstoreclient.XS_WRITE, 0, "data/c", "7")
+	if _, err := request(s, c, xenstoreclient.XS_TRANSACTION_END, tx, "T"); err != nil {
+		t.Errorf("commit error: %v", err)
+	}
+	if v := read(0, "data/b"); v != "6" {
+		t.Errorf("read after commit = %q, expected %q", v, "6")
+	}
+}
+
+func TestServerDirectoryPart(t *testing.T) {
+	s := new_server(1)
+	c := new_conn(nil)
+	var expected []string
+	for i := 0; i < 500; i++ {
+		name := fmt.Sprintf("child-%04d", i)
+		request(s, c, xenstoreclient.XS_WRITE, 0, "data/"+name, "")
+		expected = append(expected, name)
+	}
+
+	if _, err := request(s, c, xenstoreclient.XS_DIRECTORY, 0, "data"); err != E2BIG {
+		t.Errorf("directory error = %v, expected %v", err, E2BIG)
+	}
+
+	var children []string
+	gen := ""
+	for offset, parts := 0, 0; ; parts++ {
+		reply, err := request(s, c, xenstoreclient.XS_DIRECTORY_PART, 0, "data", fmt.Sprint(offset))
+		if err != nil {
+			t.Fatalf("directory part at %d error: %v", offset, err)
+		}
+		if len(reply) > xenstoreclient.XENSTORE_PAYLOAD_MAX {
+			t.Errorf("directory part at %d is %d bytes", offset, len(reply))
+		}
+		fields := strings.SplitN(reply, "\x00", 2)
+		if gen == "" {
+			gen = fields[0]
+		} else if fields[0] != gen {
+			t.Errorf("directory part at %d generation %q, expected %q", offset, fields[0], gen)
+		}
+		part := fields[1]
+		if !strings.HasSuffix(part, "\x00") {
+			t.Fatalf("directory part at %d does not end on a whole name", offset)
+		}
+		children = append(children, strings.Split(strings.TrimRight(part, "\x00"), "\x00")...)
+		offset += len(part)
+		if strings.HasSuffix(part, "\x00\x00") {
+			if parts == 0 {
+				t.Errorf("directory listed in a single part")
+			}
+			break
+		}
+	}
+	if !reflect.DeepEqual(children, expected) {
+		t.Errorf("directory parts listed %d children, expected %d", len(children), len(expected))
+	}
+
+	if _, err := request(s, c, xenstoreclient.XS_DIRECTORY_PART, 0, "data", "999999"); err != EINVAL {
+		t.Errorf("directory part past the end error = %v, expected %v", err, EINVAL)
+	}
+}
+
+// queued returns the watch events queued for c as path, token pairs.
+func queued(c *xs_conn) []string {
+	var events []string
+	for _, p := range c.queue {
+		events = append(events, strings.TrimSuffix(string(p.Value), "\x00"))
+	}
+	c.queue = nil
+	return events
+}
+
+func TestServerWatches(t *testing.T) {
+	s := new_server(1)
+	c := new_conn(nil)
+	s.conns[c] = true
+
+	if _, err := request(s, c, xenstoreclient.XS_WATCH, 0, "data", "rel"); err != nil {
+		t.Fatalf("watch error: %v", err)
+	}
+	request(s, c, xenstoreclient.XS_WATCH, 0, "/local/domain/1/data/a", "abs")
+	if _, err := request(s, c, xenstoreclient.XS_WATCH, 0, "data", "rel"); err != EEXIST {
+		t.Errorf("duplicate watch error = %v, expected %v", err, EEXIST)
+	}
+	for _, r := range []struct {
+		op       xenstoreclient.Operation
+		tx       bool
+		args     []string
+		expected []string
+	}{
+		// registering fires once
+		{xenstoreclient.XS_READ, false, []string{"domid"}, []string{"data\x00rel", "/local/domain/1/data/a\x00abs"}},
+		{xenstoreclient.XS_WRITE, false, []string{"data/a", "1"}, []string{"data/a\x00rel", "/local/domain/1/data/a\x00abs"}},
+		{xenstoreclient.XS_WRITE, false, []string{"data/b", "1"}, []string{"data/b\x00rel"}},
+		{xenstoreclient.XS_WRITE, false, []string{"other", "1"}, nil},
+		{xenstoreclient.XS_WRITE, true, []string{"data/b", "2"}, []string{"data/b\x00rel"}},
+		{xenstoreclient.XS_RM, false, []string{"data"}, []string{"data\x00rel", "/local/domain/1/data/a\x00abs"}},
+		{xenstoreclient.XS_UNWATCH, false, []string{"data", "rel"}, nil},
+		{xenstoreclient.XS_WRITE, false, []string{"data/a", "2"}, []string{"/local/domain/1/data/a\x00abs"}},
+	} {
+		var tx uint32
+		if r.tx {
+			reply, _ := request(s, c, xenstoreclient.XS_TRANSACTION_START, 0, "")
+			fmt.Sscan(strings.TrimSuffix(reply, "\x00"), &tx)
+		}
+		request(s, c, r.op, tx, r.args...)
+		if r.tx {
+			// transactions fire the watches when committed
+			if events := queued(c); events != nil {
+				t.Errorf("%v %q in a transaction queued %q", r.op, r.args, events)
+			}
+			request(s, c, xenstoreclient.XS_TRANSACTION_END, tx, "T")
+		}
+		if events := queued(c); !reflect.DeepEqual(events, r.expected) {
+			t.Errorf("%v %q queued %q, expected %q", r.op, r.args, events, r.expected)
+		}
+	}
+	if _, err := request(s, c, xenstoreclient.XS_UNWATCH, 0, "data", "rel"); err != ENOENT {
+		t.Errorf("missing unwatch error = %v, expected %v", err, ENOENT)
+	}
+}
+
+func TestConnWriteOrder(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := new_conn(server)
+	go c.write_loop()
+
+	// as in serve_conn, nothing sends once ready is closed
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			c.send(&xenstoreclient.Packet{OpCode: xenstoreclient.XS_WATCH_EVENT, Req: uint32(i)})
+		}
+		close(sent)
+	}()
+	defer func() {
+		<-sent
+		close(c.ready)
+	}()
+	for i := 0; i < 100; i++ {
+		p, err := xenstoreclient.ReadPacket(client)
+		if err != nil {
+			t.Fatalf("packet %d read error: %v", i, err)
+		}
+		if p.Req != uint32(i) {
+			t.Fatalf("packet %d received in place of %d", p.Req, i)
+		}
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	p := &xenstoreclient.Packet{OpCode: xenstoreclient.XS_READ, Req: 7, Length: 5, Value: []byte("data\x00")}
+	var b strings.Builder
+	p.Write(&b)
+	req, err := read_request(strings.NewReader(b.String()))
+	if err != nil || !reflect.DeepEqual(req, p) {
+		t.Errorf("read_request = %+v, %v, expected %+v", req, err, p)
+	}
+
+	// a header announcing more than the protocol allows is refused without
+	// waiting for, or allocating, the payload
+	header := "\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\xff\xff"
+	if req, err := read_request(strings.NewReader(header)); err != E2BIG {
+		t.Errorf("oversized read_request = %+v, %v, expected %v", req, err, E2BIG)
+	}
+
+	if _, err := read_request(strings.NewReader("")); err != io.EOF {
+		t.Errorf("read_request at the end error = %v, expected %v", err, io.EOF)
+	}
+}
+
+func TestServeConnOversized(t *testing.T) {
+	s := new_server(1)
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.serve_conn(server)
+
+	// the connection is dropped rather than the payload read
+	client.Write([]byte("\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x80"))
+	if p, err := xenstoreclient.ReadRawPacket(client); err == nil {
+		t.Errorf("oversized request got reply %+v", p)
+	}
+}
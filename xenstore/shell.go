@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	xenstoreclient "github.com/xenserver/xe-guest-utilities/xenstoreclient"
+	"golang.org/x/sys/unix"
+)
+
+type shell_cmd struct {
+	args string
+	help string
+	run  func(sh *shell, args []string) error
+}
+
+var shell_cmds map[string]shell_cmd
+
+func init() {
+	shell_cmds = map[string]shell_cmd{
+		"cd":       {"[path]", "change current path, default the domain path", (*shell).cd},
+		"pwd":      {"", "print current path", (*shell).pwd},
+		"ls":       {"[path]", "list children with their values", (*shell).ls},
+		"read":     {"path [ path ... ]", "read values", (*shell).read},
+		"write":    {"path value", "write a value", (*shell).write},
+		"rm":       {"path [ path ... ]", "remove paths", (*shell).rm},
+		"mkdir":    {"path [ path ... ]", "create empty nodes", (*shell).mkdir},
+		"getperms": {"path", "print permissions", (*shell).getperms},
+		"chmod":    {"path mode [modes...]", "set permissions", (*shell).chmod},
+		"begin":    {"", "start a transaction", (*shell).begin},
+		"commit":   {"", "commit the current transaction", (*shell).commit},
+		"abort":    {"", "abort the current transaction", (*shell).abort},
+		"history":  {"", "print command history", (*shell).print_history},
+		"help":     {"", "print this help", (*shell).help},
+		"exit":     {"", "leave the shell", nil},
+	}
+}
+
+type shell struct {
+	xs          xenstoreclient.XenStoreClient
+	domain_path string
+	cwd         string
+	tx          uint32
+	history     []string
+	out         io.Writer
+}
+
+func (sh *shell) resolve(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = sh.cwd + "/" + p
+	}
+	return path.Clean(p)
+}
+
+func (sh *shell) cd(args []string) error {
+	if len(args) > 1 {
+		return errors.New("Usage: cd [path]")
+	}
+	p := sh.domain_path
+	if len(args) == 1 {
+		p = sh.resolve(args[0])
+	}
+	if _, err := sh.xs.GetPermission(p); err != nil {
+		return fmt.Errorf("%s: %v", p, err)
+	}
+	sh.cwd = p
+	return nil
+}
+
+func (sh *shell) pwd(args []string) error {
+	fmt.Fprintln(sh.out, sh.cwd)
+	return nil
+}
+
+func (sh *shell) ls(args []string) error {
+	if len(args) > 1 {
+		return errors.New("Usage: ls [path]")
+	}
+	p := sh.cwd
+	if len(args) == 1 {
+		p = sh.resolve(args[0])
+	}
+	children, err := sh.xs.List(p)
+	if err != nil {
+		return fmt.Errorf("%s: %v", p, err)
+	}
+	sort.Strings(children)
+	for _, child := range children {
+		val, err := sh.xs.Read(join_path(p, child))
+		if err != nil {
+			fmt.Fprintf(sh.out, "%s:\n", child)
+		} else {
+			fmt.Fprintf(sh.out, "%s = \"%s\"\n", child, sanitise_value(val))
+		}
+	}
+	return nil
+}
+
+func (sh *shell) read(args []string) error {
+	if len(args) == 0 {
+		return errors.New("Usage: read path [ path ... ]")
+	}
+	for _, arg := range args {
+		val, err := sh.xs.Read(sh.resolve(arg))
+		if err != nil {
+			return fmt.Errorf("%s: %v", arg, err)
+		}
+		fmt.Fprintln(sh.out, sanitise_value(val))
+	}
+	return nil
+}
+
+func (sh *shell) write(args []string) error {
+	if len(args) != 2 {
+		return errors.New("Usage: write path value")
+	}
+	return sh.xs.Write(sh.resolve(args[0]), unsanitise_value(args[1]))
+}
+
+func (sh *shell) rm(args []string) error {
+	if len(args) == 0 {
+		return errors.New("Usage: rm path [ path ... ]")
+	}
+	for _, arg := range args {
+		if err := sh.xs.Rm(sh.resolve(arg)); err != nil {
+			return fmt.Errorf("%s: %v", arg, err)
+		}
+	}
+	return nil
+}
+
+func (sh *shell) mkdir(args []string) error {
+	if len(args) == 0 {
+		return errors.New("Usage: mkdir path [ path ... ]")
+	}
+	for _, arg := range args {
+		if err := sh.xs.Mkdir(sh.resolve(arg)); err != nil {
+			return fmt.Errorf("%s: %v", arg, err)
+		}
+	}
+	return nil
+}
+
+func (sh *shell) getperms(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: getperms path")
+	}
+	perms, err := sh.xs.GetPermission(sh.resolve(args[0]))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(sh.out, strings.Join(perms_str(perms), " "))
+	return nil
+}
+
+func (sh *shell) chmod(args []string) error {
+	if len(args) < 2 {
+		return errors.New("Usage: chmod path mode [modes...]")
+	}
+	perms, err := parse_perms(args[1:])
+	if err != nil {
+		return err
+	}
+	return sh.xs.SetPermission(sh.resolve(args[0]), perms)
+}
+
+func (sh *shell) begin(args []string) error {
+	tx, err := sh.xs.TransactionStart()
+	if err != nil {
+		return err
+	}
+	sh.tx = tx
+	return nil
+}
+
+func (sh *shell) end(commit bool) error {
+	if sh.tx == 0 {
+		return errors.New("No transaction in progress")
+	}
+	sh.tx = 0
+	return sh.xs.TransactionEnd(commit)
+}
+
+func (sh *shell) commit(args []string) error {
+	return sh.end(true)
+}
+
+func (sh *shell) abort(args []string) error {
+	return sh.end(false)
+}
+
+func (sh *shell) print_history(args []string) error {
+	for i, line := range sh.history {
+		fmt.Fprintf(sh.out, "%5d  %s\n", i+1, line)
+	}
+	return nil
+}
+
+func (sh *shell) help(args []string) error {
+	names := make([]string, 0, len(shell_cmds))
+	for name := range shell_cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := shell_cmds[name]
+		fmt.Fprintf(sh.out, "  %-30s %s\n", name+" "+cmd.args, cmd.help)
+	}
+	return nil
+}
+
+func (sh *shell) prompt() string {
+	if sh.tx != 0 {
+		return fmt.Sprintf("xenstore:%s (tx %d)> ", sh.cwd, sh.tx)
+	}
+	return fmt.Sprintf("xenstore:%s> ", sh.cwd)
+}
+
+// split_line splits a command line into words, honouring single and double
+// quotes and backslash escapes.
+func split_line(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	in_word := false
+	var quote byte
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != '\'' && c == '\\' && i+1 < len(line):
+			i++
+			word.WriteByte(line[i])
+			in_word = true
+		case quote != 0:
+			word.WriteByte(c)
+		case c == '\'' || c == '"':
+			quote = c
+			in_word = true
+		case c == ' ' || c == '\t':
+			if in_word {
+				words = append(words, word.String())
+				word.Reset()
+				in_word = false
+			}
+		default:
+			word.WriteByte(c)
+			in_word = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("Unterminated quote")
+	}
+	if in_word {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// complete returns the candidates for the last word of line.
+func (sh *shell) complete(line string) []string {
+	words := strings.Fields(line)
+	if len(words) == 0 || (len(words) == 1 && !strings.HasSuffix(line, " ")) {
+		prefix := ""
+		if len(words) == 1 {
+			prefix = words[0]
+		}
+		var candidates []string
+		for name := range shell_cmds {
+			if strings.HasPrefix(name, prefix) {
+				candidates = append(candidates, name+" ")
+			}
+		}
+		sort.Strings(candidates)
+		return candidates
+	}
+
+	partial := ""
+	if !strings.HasSuffix(line, " ") {
+		partial = words[len(words)-1]
+	}
+	dir, prefix := "", partial
+	if slash := strings.LastIndex(partial, "/"); slash >= 0 {
+		dir, prefix = partial[:slash+1], partial[slash+1:]
+	}
+	children, err := sh.xs.List(sh.resolve(dir))
+	if err != nil {
+		return nil
+	}
+	var candidates []string
+	for _, child := range children {
+		if strings.HasPrefix(child, prefix) {
+			candidates = append(candidates, dir+child)
+		}
+	}
+	sort.Strings(candidates)
+	if len(candidates) == 1 {
+		if sub, err := sh.xs.List(sh.resolve(candidates[0])); err == nil && len(sub) > 0 {
+			candidates[0] += "/"
+		} else {
+			candidates[0] += " "
+		}
+	}
+	return candidates
+}
+
+func (sh *shell) execute(line string) (quit bool) {
+	words, err := split_line(line)
+	if err != nil {
+		fmt.Fprintf(sh.out, "error: %v\n", err)
+		return false
+	}
+	if len(words) == 0 {
+		return false
+	}
+	if words[0] == "exit" || words[0] == "quit" {
+		return true
+	}
+	cmd, ok := shell_cmds[words[0]]
+	if !ok {
+		fmt.Fprintf(sh.out, "Unknown command %q, try \"help\"\n", words[0])
+		return false
+	}
+	if err := cmd.run(sh, words[1:]); err != nil {
+		fmt.Fprintf(sh.out, "error: %v\n", err)
+	}
+	return false
+}
+
+func common_prefix(strs []string) string {
+	if len(strs) == 0 {
+		return ""
+	}
+	prefix := strs[0]
+	for _, s := range strs[1:] {
+		for !strings.HasPrefix(s, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// line_editor is a minimal terminal line editor supporting cursor movement,
+// history and tab completion.
+type line_editor struct {
+	fd       int
+	in       *bufio.Reader
+	out      io.Writer
+	history  []string
+	complete func(line string) []string
+}
+
+func (le *line_editor) redraw(prompt string, buf []byte, pos int) {
+	fmt.Fprintf(le.out, "\r\x1b[K%s%s", prompt, buf)
+	if back := len(buf) - pos; back > 0 {
+		fmt.Fprintf(le.out, "\x1b[%dD", back)
+	}
+}
+
+func (le *line_editor) read_line(prompt string) (string, error) {
+	old, err := unix.IoctlGetTermios(le.fd, unix.TCGETS)
+	if err != nil {
+		return "", err
+	}
+	raw := *old
+	raw.Lflag &^= unix.ICANON | unix.ECHO | unix.ISIG | unix.IEXTEN
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(le.fd, unix.TCSETS, &raw); err != nil {
+		return "", err
+	}
+	defer unix.IoctlSetTermios(le.fd, unix.TCSETS, old)
+
+	var buf []byte
+	pos := 0
+	hist := len(le.history)
+	fmt.Fprint(le.out, prompt)
+	for {
+		c, err := le.in.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case '\r', '\n':
+			fmt.Fprint(le.out, "\r\n")
+			return string(buf), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(le.out, "^C\r\n")
+			buf, pos = buf[:0], 0
+			fmt.Fprint(le.out, prompt)
+			continue
+		case 4: // Ctrl-D
+			if len(buf) == 0 {
+				fmt.Fprint(le.out, "\r\n")
+				return "", io.EOF
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(buf)
+		case 21: // Ctrl-U
+			buf, pos = buf[pos:], 0
+		case 127, 8: // Backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+			}
+		case '\t':
+			candidates := le.complete(string(buf[:pos]))
+			if len(candidates) == 0 {
+				break
+			}
+			start := strings.LastIndexAny(string(buf[:pos]), " \t") + 1
+			prefix := common_prefix(candidates)
+			if len(prefix) > pos-start {
+				buf = append(buf[:start], append([]byte(prefix), buf[pos:]...)...)
+				pos = start + len(prefix)
+			} else if len(candidates) > 1 {
+				fmt.Fprint(le.out, "\r\n")
+				for _, candidate := range candidates {
+					fmt.Fprintf(le.out, "%s  ", path.Base(strings.TrimRight(candidate, "/ ")))
+				}
+				fmt.Fprint(le.out, "\r\n")
+			}
+		case 27: // escape sequence
+			b1, _ := le.in.ReadByte()
+			b2, _ := le.in.ReadByte()
+			if b1 != '[' {
+				break
+			}
+			switch b2 {
+			case 'A':
+				if hist > 0 {
+					hist--
+					buf = []byte(le.history[hist])
+					pos = len(buf)
+				}
+			case 'B':
+				if hist < len(le.history) {
+					hist++
+					buf = buf[:0]
+					if hist < len(le.history) {
+						buf = []byte(le.history[hist])
+					}
+					pos = len(buf)
+				}
+			case 'C':
+				if pos < len(buf) {
+					pos++
+				}
+			case 'D':
+				if pos > 0 {
+					pos--
+				}
+			}
+		default:
+			if c >= ' ' {
+				buf = append(buf[:pos], append([]byte{c}, buf[pos:]...)...)
+				pos++
+			}
+		}
+		le.redraw(prompt, buf, pos)
+	}
+}
+
+func xs_shell(script_name string, args []string) {
+	if len(args) != 0 {
+		die_usage("Usage: %s", script_name)
+	}
+
+	xs := new_xs()
+	sh := &shell{xs: xs, domain_path: "/", out: os.Stdout}
+	if domain_id, err := xs.Read("domid"); err == nil {
+		if domain_path, err := xs.GetDomainPath(strings.TrimRight(domain_id, "\x00")); err == nil {
+			sh.domain_path = strings.TrimRight(domain_path, "\x00")
+		}
+	}
+	sh.cwd = sh.domain_path
+
+	in := bufio.NewReader(os.Stdin)
+	fd := int(os.Stdin.Fd())
+	_, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	interactive := err == nil
+
+	le := &line_editor{fd: fd, in: in, out: os.Stdout, complete: sh.complete}
+	for {
+		var line string
+		var err error
+		if interactive {
+			le.history = sh.history
+			line, err = le.read_line(sh.prompt())
+		} else {
+			line, err = in.ReadString('\n')
+			if err == io.EOF && len(line) > 0 {
+				err = nil
+			}
+		}
+		if err != nil {
+			break
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		sh.history = append(sh.history, line)
+		if sh.execute(line) {
+			break
+		}
+	}
+
+	if sh.tx != 0 {
+		fmt.Fprintln(os.Stderr, "Aborting uncommitted transaction")
+		sh.end(false)
+	}
+}
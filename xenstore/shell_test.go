@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitLine(t *testing.T) {
+	for _, c := range []struct {
+		line     string
+		expected []string
+	}{
+		{"", nil},
+		{"   \t ", nil},
+		{"ls", []string{"ls"}},
+		{"  write  key\tvalue ", []string{"write", "key", "value"}},
+		{`write key "two words"`, []string{"write", "key", "two words"}},
+		{`write key 'a "b" c'`, []string{"write", "key", `a "b" c`}},
+		{`write key "a 'b' c"`, []string{"write", "key", "a 'b' c"}},
+		{`write key ""`, []string{"write", "key", ""}},
+		{`write key ''`, []string{"write", "key", ""}},
+		{`write key a\ b`, []string{"write", "key", "a b"}},
+		{`write key "a\"b"`, []string{"write", "key", `a"b`}},
+		{`write key 'a\b'`, []string{"write", "key", `a\b`}},
+		{`write key pre"quoted"post`, []string{"write", "key", "prequotedpost"}},
+		{`trailing\`, []string{`trailing\`}},
+	} {
+		words, err := split_line(c.line)
+		if err != nil {
+			t.Errorf("split_line(%q) error: %v", c.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(words, c.expected) {
+			t.Errorf("split_line(%q) = %q, expected %q", c.line, words, c.expected)
+		}
+	}
+
+	for _, line := range []string{`write key "open`, `write key 'open`, `"a\"`} {
+		if words, err := split_line(line); err == nil {
+			t.Errorf("split_line(%q) = %q, expected an error", line, words)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	xenstoreclient "github.com/xenserver/xe-guest-utilities/xenstoreclient"
+)
+
+// snapshot_node is a single node of a snapshot. Values which are not valid
+// UTF-8 are stored base64 encoded, with Encoding set to "base64".
+type snapshot_node struct {
+	Value    string   `json:"value"`
+	Encoding string   `json:"encoding,omitempty"`
+	Perms    []string `json:"perms,omitempty"`
+}
+
+// snapshot is the dump format of a subtree, with nodes keyed by their path
+// relative to Root, the root node itself having the empty key.
+type snapshot struct {
+	Root  string                   `json:"root"`
+	Nodes map[string]snapshot_node `json:"nodes"`
+}
+
+func new_snapshot_node(value string, perms []xenstoreclient.Permission) snapshot_node {
+	node := snapshot_node{Value: value}
+	if !utf8.ValidString(value) {
+		node.Value = base64.StdEncoding.EncodeToString([]byte(value))
+		node.Encoding = "base64"
+	}
+	if perms != nil {
+		node.Perms = perms_str(perms)
+	}
+	return node
+}
+
+func (n *snapshot_node) value() (string, error) {
+	switch n.Encoding {
+	case "":
+		return n.Value, nil
+	case "base64":
+		v, err := base64.StdEncoding.DecodeString(n.Value)
+		return string(v), err
+	}
+	return "", fmt.Errorf("Unknown value encoding %q", n.Encoding)
+}
+
+func rel_path(root string, path string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(path, root), "/")
+}
+
+// take_snapshot reads the subtree at root, reporting nodes which could not
+// be read to warn and leaving them out.
+func take_snapshot(xs xenstoreclient.XenStoreClient, root string, with_perms bool, warn func(path string, err error)) *snapshot {
+	snap := &snapshot{Root: root, Nodes: make(map[string]snapshot_node)}
+	walk_tree(xs, root, -1, func(path string, depth int, err error) {
+		if err != nil {
+			warn(path, err)
+		}
+		value, err := xs.Read(path)
+		if err != nil {
+			warn(path, err)
+			return
+		}
+		var perms []xenstoreclient.Permission
+		if with_perms {
+			if perms, err = xs.GetPermission(path); err != nil {
+				warn(path, err)
+			}
+		}
+		snap.Nodes[rel_path(root, path)] = new_snapshot_node(value, perms)
+	})
+	return snap
+}
+
+func load_snapshot(filename string) (*snapshot, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	snap := &snapshot{}
+	if err := json.NewDecoder(f).Decode(snap); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if snap.Nodes == nil {
+		snap.Nodes = make(map[string]snapshot_node)
+	}
+	return snap, nil
+}
+
+func xs_dump(script_name string, args []string) {
+	fs := flag.NewFlagSet(script_name, flag.ExitOnError)
+	no_perms := fs.Bool("no-perms", false, "do not record permissions")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [--no-perms] path\n", script_name)
+		fs.PrintDefaults()
+		os.Exit(EXIT_USAGE)
+	}
+	parse_flags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+
+	xs := new_xs()
+	snap := take_snapshot(xs, fs.Arg(0), !*no_perms, func(path string, err error) {
+		fmt.Fprintf(os.Stderr, "%s: %s: %v\n", script_name, path, err)
+	})
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(snap); err != nil {
+		die("%s error: %v", script_name, err)
+	}
+}
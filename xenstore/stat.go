@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	xenstoreclient "github.com/xenserver/xe-guest-utilities/xenstoreclient"
+)
+
+type value_size struct {
+	Path  string `json:"path"`
+	Bytes int    `json:"bytes"`
+}
+
+type tree_stat struct {
+	Path          string       `json:"path"`
+	Nodes         int          `json:"nodes"`
+	ValueBytes    int          `json:"value_bytes"`
+	PathBytes     int          `json:"path_bytes"`
+	MaxDepth      int          `json:"max_depth"`
+	DeepestPath   string       `json:"deepest_path"`
+	LargestValues []value_size `json:"largest_values"`
+	Errors        int          `json:"errors"`
+	Quota         string       `json:"quota,omitempty"`
+	QuotaError    string       `json:"quota_error,omitempty"`
+}
+
+func collect_stat(xs xenstoreclient.XenStoreClient, root string, top int, warn func(path string, err error)) *tree_stat {
+	st := &tree_stat{Path: root, LargestValues: make([]value_size, 0)}
+	walk_tree(xs, root, -1, func(path string, depth int, err error) {
+		if err != nil {
+			warn(path, err)
+			st.Errors++
+		}
+		st.Nodes++
+		st.PathBytes += len(path)
+		if depth > st.MaxDepth || st.DeepestPath == "" {
+			st.MaxDepth = depth
+			st.DeepestPath = path
+		}
+		value, err := xs.Read(path)
+		if err != nil {
+			warn(path, err)
+			st.Errors++
+			return
+		}
+		st.ValueBytes += len(value)
+		if top > 0 && len(value) > 0 {
+			st.LargestValues = append(st.LargestValues, value_size{path, len(value)})
+			sort.SliceStable(st.LargestValues, func(i, j int) bool {
+				return st.LargestValues[i].Bytes > st.LargestValues[j].Bytes
+			})
+			if len(st.LargestValues) > top {
+				st.LargestValues = st.LargestValues[:top]
+			}
+		}
+	})
+	return st
+}
+
+// get_quota asks xenstored for the quota limits and usage of domid, which
+// only daemons supporting the quota control command answer, and usually
+// only to privileged domains.
+func get_quota(xs xenstoreclient.XenStoreClient, domid string) (string, error) {
+	v := []byte("quota\x00" + domid + "\x00")
+	req := &xenstoreclient.Packet{
+		OpCode: xenstoreclient.XS_CONTROL,
+		Req:    0,
+		TxID:   0,
+		Length: uint32(len(v)),
+		Value:  v,
+	}
+	resp, err := xs.DO(req)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(resp.Value), "\x00"), nil
+}
+
+// path_domid returns the domid of a /local/domain/<domid> path or of a path
+// below one, or "" for other paths.
+func path_domid(path string) string {
+	rest, ok := strings.CutPrefix(path, "/local/domain/")
+	if !ok {
+		return ""
+	}
+	domid, _, _ := strings.Cut(rest, "/")
+	if _, err := strconv.ParseUint(domid, 10, 16); err != nil {
+		return ""
+	}
+	return domid
+}
+
+func xs_stat(script_name string, args []string) {
+	fs := flag.NewFlagSet(script_name, flag.ExitOnError)
+	top := fs.Int("top", 5, "report the `N` largest values")
+	as_json := fs.Bool("json", false, "print the report as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [--top N] [--json] [path]\n", script_name)
+		fs.PrintDefaults()
+		os.Exit(EXIT_USAGE)
+	}
+	parse_flags(fs, args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+	}
+
+	xs := new_xs()
+	root := fs.Arg(0)
+	// the domid is only read for the default root, other paths get the
+	// quota of the domain they are under, if any
+	domain_id := path_domid(root)
+	if root == "" {
+		id, err := xs.Read("domid")
+		if err != nil {
+			die("%s error: %v", script_name, err)
+		}
+		domain_id = strings.TrimRight(id, "\x00")
+		domain_path, err := xs.GetDomainPath(domain_id)
+		if err != nil {
+			die("%s error: %v", script_name, err)
+		}
+		root = strings.TrimRight(domain_path, "\x00")
+	}
+
+	st := collect_stat(xs, root, *top, func(path string, err error) {
+		if !*as_json {
+			fmt.Fprintf(os.Stderr, "%s: %s: %v\n", script_name, path, err)
+		}
+	})
+	if domain_id != "" {
+		var err error
+		if st.Quota, err = get_quota(xs, domain_id); err != nil {
+			st.QuotaError = err.Error()
+		}
+	}
+
+	if *as_json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(st); err != nil {
+			die("%s error: %v", script_name, err)
+		}
+		return
+	}
+
+	fmt.Printf("Path:         %s\n", st.Path)
+	fmt.Printf("Nodes:        %d\n", st.Nodes)
+	fmt.Printf("Value bytes:  %d\n", st.ValueBytes)
+	fmt.Printf("Path bytes:   %d\n", st.PathBytes)
+	fmt.Printf("Max depth:    %d (%s)\n", st.MaxDepth, st.DeepestPath)
+	if st.Errors != 0 {
+		fmt.Printf("Errors:       %d\n", st.Errors)
+	}
+	if len(st.LargestValues) != 0 {
+		fmt.Println("Largest values:")
+		for _, v := range st.LargestValues {
+			fmt.Printf("  %8d  %s\n", v.Bytes, v.Path)
+		}
+	}
+	if domain_id == "" {
+		return
+	}
+	if st.QuotaError != "" {
+		fmt.Printf("Quota:        not available (%s)\n", st.QuotaError)
+	} else {
+		fmt.Printf("Quota for domain %s:\n", domain_id)
+		for _, line := range strings.Split(st.Quota, "\n") {
+			if line != "" {
+				fmt.Printf("  %s\n", line)
+			}
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPathDomid(t *testing.T) {
+	for path, domid := range map[string]string{
+		"":                        "",
+		"/":                       "",
+		"/local/domain/5":         "5",
+		"/local/domain/5/data/os": "5",
+		"/local/domain/12/":       "12",
+		"/local/domain/":          "",
+		"/local/domain/x/data":    "",
+		"/local/domain/99999":     "",
+		"/vm/5/name":              "",
+		"local/domain/5":          "",
+	} {
+		if got := path_domid(path); got != domid {
+			t.Errorf("path_domid(%q) = %q, expected %q", path, got, domid)
+		}
+	}
+}
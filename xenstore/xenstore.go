@@ -2,45 +2,177 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 
 	xenstoreclient "github.com/xenserver/xe-guest-utilities/xenstoreclient"
 	"golang.org/x/sys/unix"
 )
 
-func die(format string, a ...interface{}) {
+// Exit statuses, documented in usage.
+const (
+	EXIT_NOT_FOUND  = 1
+	EXIT_USAGE      = 2
+	EXIT_PERMISSION = 3
+	EXIT_CONNECTION = 4
+	EXIT_ERROR      = 5
+)
+
+// exit_status maps an error to the exit status reporting it, looking
+// through any wrapping down to the error xenstored replied with.
+func exit_status(err error) int {
+	root := err
+	for e := errors.Unwrap(root); e != nil; e = errors.Unwrap(root) {
+		root = e
+	}
+	switch root.Error() {
+	case "ENOENT":
+		return EXIT_NOT_FOUND
+	case "EACCES", "EPERM":
+		return EXIT_PERMISSION
+	}
+	var op_err *net.OpError
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &op_err) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) {
+		return EXIT_CONNECTION
+	}
+	return EXIT_ERROR
+}
+
+func die_status(status int, format string, a ...interface{}) {
 	fmt.Fprintf(os.Stderr, format, a...)
 	fmt.Fprintln(os.Stderr)
-	os.Exit(1)
+	os.Exit(status)
+}
+
+// die exits with the status for the first error among a, or EXIT_ERROR.
+func die(format string, a ...interface{}) {
+	status := EXIT_ERROR
+	for _, arg := range a {
+		if err, ok := arg.(error); ok {
+			status = exit_status(err)
+			break
+		}
+	}
+	die_status(status, format, a...)
+}
+
+func die_usage(format string, a ...interface{}) {
+	die_status(EXIT_USAGE, format, a...)
 }
 
 func usage() {
-	die(
-		`Usage: xenstore read key [ key ... ]
-                list key [ key ... ]
-                write key value [ key value ... ]
-                rm key [ key ... ]
+	die_usage(
+		`Usage: xenstore read [-p] [-R] key [ key ... ]
+                list [-p] key [ key ... ]
+                write [-R] key value [ key value ... ]
+                write -f FILE|- key
+                rm [-t] key [ key ... ]
                 exists key [ key ... ]
-                ls [ key ... ]
-                chmod key mode [modes...]
-                watch [-n NR] key [ key ... ]`)
+                mkdir key [ key ... ]
+                getperms key [ key ... ]
+                ls [-f] [-p] [--max-depth N] [--sort] [--no-values] [ key ... ]
+                chmod [-r] [-u] key mode [modes...]
+                watch [-n NR] key [ key ... ]
+                shell
+                find [--key RE] [--value RE] [--max-depth N] [--values] [--json] path [ path ... ]
+                dump [--no-perms] path
+                diff [--perms] path|@snapshot path|@snapshot
+                diff [--perms] --interval DURATION [--count N] path
+                cp [-r] [-p] src dst
+                mv src dst
+                stat [--top N] [--json] [path]
+                monitor [--interval DURATION] [--text] [--top N] path [ path ... ]
+                bench [--workload LIST] [--ops N] [--clients N] [--keys N] [--size BYTES] [--path PATH]
+                env [--prefix PREFIX] [--naming upper|lower|keep] [--all] [--max-depth N] path -- command [ args ... ]
+                env [--prefix PREFIX] [--naming upper|lower|keep] [--all] [--max-depth N] --export path
+                completion bash|zsh|fish
+                serve --socket PATH [--load FILE] [--domid ID] [--verbose]
+                proxy --listen PATH --upstream PATH [--log FILE]
+
+read prints values with backslashes, tabs, newlines and other non-printable
+characters escaped, as \\, \t, \n, \NNN or \xNN, or unchanged with -R.
+Likewise write turns these escapes in values back into the characters, so a
+literal backslash must be written as \\. Use -R to write values unchanged, or
+-f for binary values.
+
+Exit status is 0 on success, 1 if a key does not exist, 2 for invalid usage,
+3 if permission is denied, 4 if the connection to xenstored fails and 5 for
+any other error. diff also exits with 1 when it finds differences.`)
+}
+
+// get_opts strips the leading single letter options from args, which may be
+// combined as in "-fp", stopping at the first non option argument or "--".
+// Any option not listed in valid, or "-h", calls usage.
+func get_opts(args []string, valid string, usage func()) (map[byte]bool, []string) {
+	opts := make(map[byte]bool)
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for i := 1; i < len(arg); i++ {
+			if arg[i] == 'h' || !strings.ContainsRune(valid, rune(arg[i])) {
+				usage()
+			}
+			opts[arg[i]] = true
+		}
+	}
+	return opts, args
+}
+
+// is_option tells whether an argument looks like an option rather than a
+// path, "-" alone standing for stdin.
+func is_option(arg string) bool {
+	return len(arg) > 1 && arg[0] == '-'
+}
+
+// parse_flags parses the options of a subcommand, which like those of
+// get_opts come before its arguments. An option found among the arguments
+// before any "--" would otherwise be silently taken as an argument, so it
+// calls the usage of fs instead.
+func parse_flags(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	rest := fs.Args()
+	if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+		// the options were ended by "--"
+		return
+	}
+	for _, arg := range rest {
+		if arg == "--" {
+			break
+		}
+		if is_option(arg) {
+			fmt.Fprintf(fs.Output(), "%s: option %s must come before the arguments\n", fs.Name(), arg)
+			fs.Usage()
+		}
+	}
 }
 
 func new_xs() xenstoreclient.XenStoreClient {
 	xs, err := xenstoreclient.NewXenstore(0)
 	if err != nil {
-		die("xenstore.Open error: %v", err)
+		die_status(EXIT_CONNECTION, "xenstore.Open error: %v", err)
 	}
 
 	return xs
 }
 
 func xs_read(script_name string, args []string) {
-	if len(args) == 0 || args[0] == "-h" {
-		die("Usage: %s key [ key ... ]", script_name)
+	read_usage := func() {
+		die_usage("Usage: %s [-p] [-R] key [ key ... ]", script_name)
+	}
+	opts, args := get_opts(args, "pR", read_usage)
+	if len(args) == 0 {
+		read_usage()
 	}
 
 	xs := new_xs()
@@ -50,13 +182,24 @@ func xs_read(script_name string, args []string) {
 			die("%s error: %v", script_name, err)
 		}
 
-		fmt.Println(result)
+		if !opts['R'] {
+			result = sanitise_value(result)
+		}
+		if opts['p'] {
+			fmt.Printf("%s: %s\n", key, result)
+		} else {
+			fmt.Println(result)
+		}
 	}
 }
 
 func xs_list(script_name string, args []string) {
-	if len(args) == 0 || args[0] == "-h" {
-		die("Usage: %s key [ key ... ]", script_name)
+	list_usage := func() {
+		die_usage("Usage: %s [-p] key [ key ... ]", script_name)
+	}
+	opts, args := get_opts(args, "p", list_usage)
+	if len(args) == 0 {
+		list_usage()
 	}
 
 	xs := new_xs()
@@ -67,20 +210,72 @@ func xs_list(script_name string, args []string) {
 		}
 
 		for _, subPath := range result {
-			fmt.Println(subPath)
+			if opts['p'] {
+				fmt.Println(join_path(key, subPath))
+			} else {
+				fmt.Println(subPath)
+			}
 		}
 	}
 }
 
+func xs_write_usage(script_name string) {
+	die_usage("Usage: %s [-R] key value [ key value ... ]\n       %s -f FILE key\n       %s - key", script_name, script_name, script_name)
+}
+
+func check_write_size(key string, value string) error {
+	if len(key)+1+len(value) > xenstoreclient.XENSTORE_PAYLOAD_MAX {
+		return fmt.Errorf("%s: value of %d bytes exceeds the protocol limit of %d bytes including the path",
+			key, len(value), xenstoreclient.XENSTORE_PAYLOAD_MAX)
+	}
+	return nil
+}
+
 func xs_write(script_name string, args []string) {
-	if len(args) == 0 || args[0] == "-h" || len(args)%2 != 0 {
-		die("Usage: %s key value [ key value ... ]", script_name)
+	// "write - key" is short for "write -f - key"
+	if len(args) == 2 && args[0] == "-" {
+		args = []string{"-f", "-", args[1]}
+	}
+
+	if len(args) > 0 && args[0] == "-f" {
+		if len(args) != 3 {
+			xs_write_usage(script_name)
+		}
+		var data []byte
+		var err error
+		if args[1] == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(args[1])
+		}
+		if err != nil {
+			die("%s error: %v", script_name, err)
+		}
+		key, value := args[2], string(data)
+		if err := check_write_size(key, value); err != nil {
+			die("%s error: %v", script_name, err)
+		}
+		if err := new_xs().Write(key, value); err != nil {
+			die("%s error: %v", script_name, err)
+		}
+		return
+	}
+
+	opts, args := get_opts(args, "R", func() { xs_write_usage(script_name) })
+	if len(args) == 0 || len(args)%2 != 0 {
+		xs_write_usage(script_name)
 	}
 
 	xs := new_xs()
 	for i := 0; i < len(args); i += 2 {
 		key := args[i]
 		value := args[i+1]
+		if !opts['R'] {
+			value = unsanitise_value(value)
+		}
+		if err := check_write_size(key, value); err != nil {
+			die("%s error: %v", script_name, err)
+		}
 
 		err := xs.Write(key, value)
 		if err != nil {
@@ -90,8 +285,12 @@ func xs_write(script_name string, args []string) {
 }
 
 func xs_rm(script_name string, args []string) {
-	if len(args) == 0 || args[0] == "-h" {
-		die("Usage: %s key [ key ... ]", script_name)
+	rm_usage := func() {
+		die_usage("Usage: %s [-t] key [ key ... ]", script_name)
+	}
+	opts, args := get_opts(args, "t", rm_usage)
+	if len(args) == 0 {
+		rm_usage()
 	}
 
 	xs := new_xs()
@@ -100,23 +299,98 @@ func xs_rm(script_name string, args []string) {
 		if err != nil {
 			die("%s error: %v", script_name, err)
 		}
+		if opts['t'] {
+			tidy_parents(xs, key)
+		}
+	}
+}
+
+// tidy_parents removes the containing directories of path that are left
+// with neither children nor a value, walking up towards the root.
+func tidy_parents(xs xenstoreclient.XenStoreClient, path string) {
+	for {
+		slash := strings.LastIndex(path, "/")
+		if slash <= 0 {
+			return
+		}
+		path = path[:slash]
+
+		val, err := xs.Read(path)
+		if err != nil || len(val) != 0 {
+			return
+		}
+		children, err := xs.List(path)
+		if err != nil || len(children) != 0 {
+			return
+		}
+		if err := xs.Rm(path); err != nil {
+			return
+		}
 	}
 }
 
 func xs_exists(script_name string, args []string) {
 	if len(args) == 0 || args[0] == "-h" {
-		die("Usage: %s key [ key ... ]", script_name)
+		die_usage("Usage: %s key [ key ... ]", script_name)
+	}
+
+	xs := new_xs()
+	for _, key := range args[:] {
+		// unlike Read this also works for nodes without a value
+		_, err := xs.GetPermission(key)
+		if err != nil && exit_status(err) == EXIT_NOT_FOUND {
+			os.Exit(EXIT_NOT_FOUND)
+		} else if err != nil {
+			die("%s error: %v", script_name, err)
+		}
+	}
+}
+
+func xs_mkdir(script_name string, args []string) {
+	if len(args) == 0 || args[0] == "-h" {
+		die_usage("Usage: %s key [ key ... ]", script_name)
+	}
+
+	xs := new_xs()
+	for _, key := range args[:] {
+		err := xs.Mkdir(key)
+		if err != nil {
+			die("%s error: %v", script_name, err)
+		}
+	}
+}
+
+func perms_str(perms []xenstoreclient.Permission) []string {
+	strs := make([]string, 0, len(perms))
+	for _, p := range perms {
+		strs = append(strs, p.ToStr())
+	}
+	return strs
+}
+
+func xs_getperms(script_name string, args []string) {
+	if len(args) == 0 || args[0] == "-h" {
+		die_usage("Usage: %s key [ key ... ]", script_name)
 	}
 
 	xs := new_xs()
 	for _, key := range args[:] {
-		_, err := xs.Read(key)
+		perms, err := xs.GetPermission(key)
 		if err != nil {
 			die("%s error: %v", script_name, err)
 		}
+
+		fmt.Println(strings.Join(perms_str(perms), " "))
 	}
 }
 
+func join_path(path string, sub_path string) string {
+	if len(path) > 0 && path[len(path)-1] == '/' {
+		return path + sub_path
+	}
+	return path + "/" + sub_path
+}
+
 var max_width = 80
 
 const TAG = " = \"...\""
@@ -126,83 +400,211 @@ const STRING_MAX = (XENSTORE_ABS_PATH_MAX + 1024)
 func sanitise_value(val string) string {
 	var builder strings.Builder
 
-	for _, r := range val {
+	for i := 0; i < len(val); i++ {
+		c := val[i]
 		switch {
-		case r >= ' ' && r <= '~' && r != '\\':
-			builder.WriteRune(r)
-		case r == '\t':
+		case c >= ' ' && c <= '~' && c != '\\':
+			builder.WriteByte(c)
+		case c == '\t':
 			builder.WriteString("\\t")
-		case r == '\n':
+		case c == '\n':
 			builder.WriteString("\\n")
-		case r == '\r':
+		case c == '\r':
 			builder.WriteString("\\r")
-		case r == '\\':
+		case c == '\\':
 			builder.WriteString("\\\\")
-		case r < '\010':
-			builder.WriteString(fmt.Sprintf("%03o", r))
+		case c < '\010':
+			builder.WriteString(fmt.Sprintf("\\%03o", c))
 		default:
-			builder.WriteString(fmt.Sprintf("x%02x", r))
+			builder.WriteString(fmt.Sprintf("\\x%02x", c))
 		}
 	}
 
 	return builder.String()
 }
 
-func do_xs_ls(xs xenstoreclient.XenStoreClient, path string, depth int) {
-	result, err := xs.List(path)
-	if err != nil {
-		die("xs_ls error: %v %s", err, path)
+func is_octal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// unsanitise_value reverses sanitise_value, also accepting octal escapes of
+// one to three digits and treating any other escaped character literally.
+func unsanitise_value(val string) string {
+	var builder strings.Builder
+
+	for i := 0; i < len(val); i++ {
+		c := val[i]
+		if c != '\\' || i+1 == len(val) {
+			builder.WriteByte(c)
+			continue
+		}
+		i++
+		switch c = val[i]; {
+		case c == 't':
+			builder.WriteByte('\t')
+		case c == 'n':
+			builder.WriteByte('\n')
+		case c == 'r':
+			builder.WriteByte('\r')
+		case c == 'x' && i+2 < len(val):
+			if b, err := strconv.ParseUint(val[i+1:i+3], 16, 8); err == nil {
+				builder.WriteByte(byte(b))
+				i += 2
+			} else {
+				builder.WriteByte(c)
+			}
+		case is_octal(c):
+			n := 1
+			for n < 3 && i+n < len(val) && is_octal(val[i+n]) {
+				n++
+			}
+			b, _ := strconv.ParseUint(val[i:i+n], 8, 16)
+			builder.WriteByte(byte(b))
+			i += n - 1
+		default:
+			builder.WriteByte(c)
+		}
+	}
+
+	return builder.String()
+}
+
+type ls_opts struct {
+	full_path  bool
+	show_perms bool
+	no_values  bool
+	sorted     bool
+	max_depth  int
+}
+
+// do_xs_ls prints the subtree below path, reporting nodes which cannot be
+// read or listed inline and carrying on. It returns the first error.
+func do_xs_ls(xs xenstoreclient.XenStoreClient, path string, children []string, depth int, opts ls_opts) error {
+	var first_err error
+	if opts.sorted {
+		sort.Strings(children)
 	}
-	for _, sub_path := range result {
+	for _, sub_path := range children {
 		if len(sub_path) == 0 {
 			continue
 		}
-		slash := "/"
-		if len(path) > 0 && path[len(path)-1] == '/' {
-			slash = ""
-		}
-		newPath := path + slash + sub_path
+		newPath := join_path(path, sub_path)
 
+		name := sub_path
 		col := 0
-		for col < depth {
-			fmt.Print(" ")
-			col++
+		if opts.full_path {
+			name = newPath
+		} else {
+			for col < depth {
+				fmt.Print(" ")
+				col++
+			}
+		}
+
+		perms := ""
+		if opts.show_perms {
+			if p, err := xs.GetPermission(newPath); err != nil {
+				perms = "  (ERROR)"
+			} else {
+				perms = "  (" + strings.Join(perms_str(p), ", ") + ")"
+			}
 		}
 
-		n := len(sub_path)
-		if n > (max_width - len(TAG) - col) {
-			n = (max_width - len(TAG) - col)
+		n := len(name)
+		if !opts.full_path && n > (max_width-len(TAG)-len(perms)-col) {
+			n = max_width - len(TAG) - len(perms) - col
+			if n < 0 {
+				n = 0
+			}
 		}
-		fmt.Printf(sub_path[:n])
+		fmt.Print(name[:n])
 		col += n
 
-		if len(newPath) >= STRING_MAX {
-			fmt.Println(":")
+		if opts.no_values || len(newPath) >= STRING_MAX {
+			fmt.Println(perms)
 		} else {
 			val, err := xs.Read(newPath)
 			if err != nil {
-				fmt.Println(":")
+				fmt.Printf(": (error: %v)%s\n", err, perms)
+				if first_err == nil {
+					first_err = err
+				}
 			} else {
 				val = sanitise_value(val)
-				if (col + len(val) + len(TAG)) > max_width {
-					n := max_width - col - len(TAG)
+				if !opts.full_path && (col+len(val)+len(TAG)+len(perms)) > max_width {
+					n := max_width - col - len(TAG) - len(perms)
 					if n < 0 {
 						n = 0
 					}
-					fmt.Printf(" = \"%s...\"\n", val[:n])
+					fmt.Printf(" = \"%s...\"%s\n", val[:n], perms)
 				} else {
-					fmt.Printf(" = \"%s\"\n", val)
+					fmt.Printf(" = \"%s\"%s\n", val, perms)
 				}
 			}
 		}
 
-		do_xs_ls(xs, newPath, depth+1)
+		if opts.max_depth >= 0 && depth+1 >= opts.max_depth {
+			continue
+		}
+		grandchildren, err := xs.List(newPath)
+		if err != nil {
+			indent := depth + 1
+			if opts.full_path {
+				indent = 0
+			}
+			fmt.Printf("%s(error listing %s: %v)\n", strings.Repeat(" ", indent), newPath, err)
+			if first_err == nil {
+				first_err = err
+			}
+			continue
+		}
+		if err := do_xs_ls(xs, newPath, grandchildren, depth+1, opts); err != nil && first_err == nil {
+			first_err = err
+		}
 	}
+	return first_err
+}
+
+func xs_ls_usage(script_name string) {
+	die_usage("Usage: %s [-f] [-p] [--max-depth N] [--sort] [--no-values] [ key ... ]", script_name)
 }
 
 func xs_ls(script_name string, args []string) {
-	if len(args) == 1 && args[0] == "-h" {
-		die("Usage: %s [ key ... ]", script_name)
+	opts := ls_opts{max_depth: -1}
+	var keys []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			keys = append(keys, args[i+1:]...)
+			i = len(args)
+		case arg == "--sort":
+			opts.sorted = true
+		case arg == "--no-values":
+			opts.no_values = true
+		case arg == "--max-depth" || strings.HasPrefix(arg, "--max-depth="):
+			value := strings.TrimPrefix(arg, "--max-depth=")
+			if arg == "--max-depth" {
+				if i+1 == len(args) {
+					xs_ls_usage(script_name)
+				}
+				i++
+				value = args[i]
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				xs_ls_usage(script_name)
+			}
+			opts.max_depth = n
+		case strings.HasPrefix(arg, "--"):
+			xs_ls_usage(script_name)
+		case len(arg) > 1 && arg[0] == '-':
+			flags, _ := get_opts([]string{arg}, "fp", func() { xs_ls_usage(script_name) })
+			opts.full_path = opts.full_path || flags['f']
+			opts.show_perms = opts.show_perms || flags['p']
+		default:
+			keys = append(keys, arg)
+		}
 	}
 
 	const TIOCGWINSZ = 0x5413
@@ -212,70 +614,123 @@ func xs_ls(script_name string, args []string) {
 	}
 
 	xs := new_xs()
-	if len(args) != 0 {
-		for _, key := range args[:] {
-			do_xs_ls(xs, key, 0)
-		}
-	} else {
+	if len(keys) == 0 {
 		domain_id, err := xs.Read("domid")
+		if err != nil {
+			die("%s error: %v", script_name, err)
+		}
+		domain_path, err := xs.GetDomainPath(strings.TrimRight(domain_id, "\x00"))
+		if err != nil {
+			die("%s error: %v", script_name, err)
+		}
+		keys = []string{strings.TrimRight(domain_path, "\x00")}
+	}
+
+	// carry on past errors, exiting with the status of the first
+	var first_err error
+	for _, key := range keys {
+		children, err := xs.List(key)
 		if err == nil {
-			domain_path, err := xs.GetDomainPath(strings.TrimRight(domain_id, "\x00"))
-			if err == nil {
-				do_xs_ls(xs, strings.TrimRight(domain_path, "\x00"), 0)
-			}
+			err = do_xs_ls(xs, key, children, 0, opts)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s error: %v %s\n", script_name, err, key)
 		}
+		if err != nil && first_err == nil {
+			first_err = err
+		}
+	}
+	if first_err != nil {
+		os.Exit(exit_status(first_err))
 	}
 }
 
-func xs_chmod(script_name string, args []string) {
-	if len(args) < 2 || args[0] == "-h" {
-		die("Usage: %s key mode [modes...]", script_name)
+func parse_perms(modes []string) ([]xenstoreclient.Permission, error) {
+	var perms []xenstoreclient.Permission
+
+	for _, m := range modes {
+		if len(m) < 2 {
+			return nil, errors.New("Invalid mode length")
+		}
+		var p xenstoreclient.Permission
+		switch m[0] {
+		case 'n':
+			p.Pe = xenstoreclient.PERM_NONE
+		case 'r':
+			p.Pe = xenstoreclient.PERM_READ
+		case 'w':
+			p.Pe = xenstoreclient.PERM_WRITE
+		case 'b':
+			p.Pe = xenstoreclient.PERM_READWRITE
+		default:
+			return nil, errors.New("Invalid mode string")
+		}
+		id, err := strconv.ParseUint(m[1:], 10, 0)
+		if err != nil {
+			return nil, err
+		}
+		p.Id = uint(id)
+		perms = append(perms, p)
 	}
+	return perms, nil
+}
 
-	var err error
-	key := args[0]
-	var perms []xenstoreclient.Permission
+func do_chmod(xs xenstoreclient.XenStoreClient, path string, perms []xenstoreclient.Permission, upto bool, recurse bool) error {
+	if len(path) == 0 {
+		return nil
+	}
+	if err := xs.SetPermission(path, perms); err != nil {
+		return fmt.Errorf("%w setting permissions on '%s'", err, path)
+	}
 
-	for _, m := range args[1:] {
-		if len(m) > 1 {
-			var p xenstoreclient.Permission
-			switch m[0] {
-			case 'n':
-				p.Pe = xenstoreclient.PERM_NONE
-			case 'r':
-				p.Pe = xenstoreclient.PERM_READ
-			case 'w':
-				p.Pe = xenstoreclient.PERM_WRITE
-			case 'b':
-				p.Pe = xenstoreclient.PERM_READWRITE
-			default:
-				err = errors.New("Invalid mode string")
-			}
-			if err == nil {
-				var id uint64
-				id, err = strconv.ParseUint(m[1:], 10, 0)
-				if err == nil {
-					p.Id = uint(id)
-					perms = append(perms, p)
-				}
-			}
-		} else {
-			err = errors.New("Invalid mode length")
+	if upto {
+		// apply same permissions to all parent entries
+		slash := strings.LastIndex(path, "/")
+		if slash < 0 {
+			return fmt.Errorf("Unable to locate path separator '/' in '%s'", path)
+		}
+		if err := do_chmod(xs, path[:slash], perms, true, false); err != nil {
+			return err
 		}
+	}
+
+	if recurse {
+		children, err := xs.List(path)
 		if err != nil {
-			die("%s error: %v", script_name, err)
+			return fmt.Errorf("%w listing '%s'", err, path)
+		}
+		for _, child := range children {
+			if err := do_chmod(xs, join_path(path, child), perms, false, true); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
+}
+
+func xs_chmod(script_name string, args []string) {
+	chmod_usage := func() {
+		die_usage("Usage: %s [-r] [-u] key mode [modes...]", script_name)
+	}
+	opts, args := get_opts(args, "ru", chmod_usage)
+	if len(args) < 2 {
+		chmod_usage()
+	}
+
+	key := args[0]
+	perms, err := parse_perms(args[1:])
+	if err != nil {
+		die("%s error: %v", script_name, err)
+	}
 
 	xs := new_xs()
-	err = xs.SetPermission(key, perms)
+	err = do_chmod(xs, key, perms, opts['u'], opts['r'])
 	if err != nil {
 		die("%s error: %v", script_name, err)
 	}
 }
 
 func xs_watch_die(script_name string) {
-	die("Usage: %s [-n NR] key [ key ... ]", script_name)
+	die_usage("Usage: %s [-n NR] key [ key ... ]", script_name)
 }
 
 func xs_watch(script_name string, args []string) {
@@ -310,12 +765,12 @@ func xs_watch(script_name string, args []string) {
 			if e, ok := <-out; ok {
 				fmt.Println(e.Path)
 			} else {
-				os.Exit(1)
+				die_status(EXIT_CONNECTION, "%s error: connection to xenstored lost", script_name)
 			}
 		}
 		xs.StopWatch()
 	} else {
-		os.Exit(1)
+		die("%s error: %v", script_name, err)
 	}
 }
 
@@ -349,10 +804,42 @@ func main() {
 		xs_exists(script_name, args)
 	case "ls":
 		xs_ls(script_name, args)
+	case "mkdir":
+		xs_mkdir(script_name, args)
+	case "getperms":
+		xs_getperms(script_name, args)
 	case "chmod":
 		xs_chmod(script_name, args)
 	case "watch":
 		xs_watch(script_name, args)
+	case "shell":
+		xs_shell(script_name, args)
+	case "find":
+		xs_find(script_name, args)
+	case "dump":
+		xs_dump(script_name, args)
+	case "diff":
+		xs_diff(script_name, args)
+	case "cp":
+		xs_cp(script_name, args)
+	case "mv":
+		xs_mv(script_name, args)
+	case "stat":
+		xs_stat(script_name, args)
+	case "monitor":
+		xs_monitor(script_name, args)
+	case "bench":
+		xs_bench(script_name, args)
+	case "env":
+		xs_env(script_name, args)
+	case "completion":
+		xs_completion(script_name, args)
+	case "serve":
+		xs_serve(script_name, args)
+	case "proxy":
+		xs_proxy(script_name, args)
+	case "__complete":
+		xs_complete(script_name, args)
 	default:
 		usage()
 	}
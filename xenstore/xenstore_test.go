@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	xenstoreclient "github.com/xenserver/xe-guest-utilities/xenstoreclient"
+)
+
+func TestExitStatus(t *testing.T) {
+	for _, c := range []struct {
+		err      error
+		expected int
+	}{
+		{errors.New("ENOENT"), EXIT_NOT_FOUND},
+		{fmt.Errorf("data/a: %w", errors.New("ENOENT")), EXIT_NOT_FOUND},
+		{fmt.Errorf("cp: %w", fmt.Errorf("data/a: %w", errors.New("ENOENT"))), EXIT_NOT_FOUND},
+		{errors.New("EACCES"), EXIT_PERMISSION},
+		{fmt.Errorf("%w setting permissions on 'a'", errors.New("EPERM")), EXIT_PERMISSION},
+		{io.EOF, EXIT_CONNECTION},
+		{io.ErrUnexpectedEOF, EXIT_CONNECTION},
+		{fmt.Errorf("data/a: %w", io.EOF), EXIT_CONNECTION},
+		{fmt.Errorf("data/a: %w", io.ErrUnexpectedEOF), EXIT_CONNECTION},
+		{&net.OpError{Op: "dial", Net: "unix", Err: syscall.ECONNREFUSED}, EXIT_CONNECTION},
+		{fmt.Errorf("write: %w", syscall.EPIPE), EXIT_CONNECTION},
+		{syscall.ECONNRESET, EXIT_CONNECTION},
+		{errors.New("EINVAL"), EXIT_ERROR},
+		{errors.New("E2BIG"), EXIT_ERROR},
+		{fmt.Errorf("data/a: %v", errors.New("ENOENT")), EXIT_ERROR},
+	} {
+		if got := exit_status(c.err); got != c.expected {
+			t.Errorf("exit_status(%v) = %d, expected %d", c.err, got, c.expected)
+		}
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	for _, c := range []struct {
+		args     []string
+		key      string
+		rest     []string
+		rejected bool
+	}{
+		{[]string{"--key", "name", "/local"}, "name", []string{"/local"}, false},
+		{[]string{"/local", "/vm"}, "", []string{"/local", "/vm"}, false},
+		{[]string{"/local", "--key", "name"}, "", nil, true},
+		{[]string{"/local", "-key=name"}, "", nil, true},
+		{[]string{"--key", "a", "-"}, "a", []string{"-"}, false},
+		{[]string{"--", "-odd"}, "", []string{"-odd"}, false},
+		{[]string{"/local", "--", "-odd"}, "", []string{"/local", "--", "-odd"}, false},
+	} {
+		fs := flag.NewFlagSet("find", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		key := fs.String("key", "", "")
+		rejected := false
+		fs.Usage = func() { rejected = true }
+		parse_flags(fs, c.args)
+		if rejected != c.rejected {
+			t.Errorf("parse_flags(%q) rejected %v, expected %v", c.args, rejected, c.rejected)
+			continue
+		}
+		if !c.rejected && (*key != c.key || !reflect.DeepEqual(fs.Args(), c.rest)) {
+			t.Errorf("parse_flags(%q) = key %q args %q, expected %q %q", c.args, *key, fs.Args(), c.key, c.rest)
+		}
+	}
+}
+
+func TestSanitiseValue(t *testing.T) {
+	for val, expected := range map[string]string{
+		"":             "",
+		"plain text ~": "plain text ~",
+		"a\tb\nc\rd":   `a\tb\nc\rd`,
+		`back\slash`:   `back\\slash`,
+		"\x00\x07":     `\000\007`,
+		"\x08\x1b\x7f": `\x08\x1b\x7f`,
+		"\xff\xfe":     `\xff\xfe`,
+		"\x00" + "1":   `\0001`,
+		"caf\xc3\xa9":  `caf\xc3\xa9`,
+	} {
+		if got := sanitise_value(val); got != expected {
+			t.Errorf("sanitise_value(%q) = %q, expected %q", val, got, expected)
+		}
+	}
+}
+
+func TestUnsanitiseValue(t *testing.T) {
+	for val, expected := range map[string]string{
+		"":            "",
+		"plain":       "plain",
+		`a\tb\nc\rd`:  "a\tb\nc\rd",
+		`back\\slash`: `back\slash`,
+		`\0`:          "\x00",
+		`\07`:         "\x07",
+		`\101\1012`:   "AA2",
+		`\x41\x4a`:    "AJ",
+		`\xzz`:        "xzz",
+		`\x4`:         "x4",
+		`\q\"`:        `q"`,
+		`trailing\`:   `trailing\`,
+	} {
+		if got := unsanitise_value(val); got != expected {
+			t.Errorf("unsanitise_value(%q) = %q, expected %q", val, got, expected)
+		}
+	}
+}
+
+func TestSanitiseRoundTrip(t *testing.T) {
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	for _, val := range []string{
+		"",
+		string(all),
+		"\x00" + "123",
+		"\x07" + "8",
+		`\x41 \n`,
+		"ends with \\",
+	} {
+		if got := unsanitise_value(sanitise_value(val)); got != val {
+			t.Errorf("unsanitise_value(sanitise_value(%q)) = %q", val, got)
+		}
+	}
+}
+
+// failing_list_xs fails to list one path, as when a node may not be read.
+type failing_list_xs struct {
+	xenstoreclient.XenStoreClient
+	path string
+}
+
+func (xs failing_list_xs) List(path string) ([]string, error) {
+	if path == xs.path {
+		return nil, errors.New("EACCES")
+	}
+	return xs.XenStoreClient.List(path)
+}
+
+func TestChmodRecursive(t *testing.T) {
+	xs := test_xs(t)
+	for _, path := range []string{"data/a/b", "data/a/c/d", "data/e"} {
+		if err := xs.Write(path, "x"); err != nil {
+			t.Fatalf("write %s error: %v", path, err)
+		}
+	}
+	perms, _ := parse_perms([]string{"n1", "r0"})
+
+	if err := do_chmod(xs, "data/a", perms, false, true); err != nil {
+		t.Fatalf("do_chmod error: %v", err)
+	}
+	for path, expected := range map[string]string{
+		"data/a":     "n1 r0",
+		"data/a/b":   "n1 r0",
+		"data/a/c/d": "n1 r0",
+		"data/e":     "n0",
+	} {
+		got, err := xs.GetPermission(path)
+		if err != nil {
+			t.Errorf("getperms %s error: %v", path, err)
+			continue
+		}
+		if s := strings.Join(perms_str(got), " "); s != expected {
+			t.Errorf("%s has perms %q, expected %q", path, s, expected)
+		}
+	}
+
+	// a subtree which cannot be listed fails the whole chmod
+	failing := failing_list_xs{xs, "data/a/c"}
+	err := do_chmod(failing, "data/a", perms, false, true)
+	if err == nil {
+		t.Fatalf("do_chmod of an unlistable subtree succeeded")
+	}
+	if status := exit_status(err); status != EXIT_PERMISSION {
+		t.Errorf("do_chmod error %v has exit status %d, expected %d", err, status, EXIT_PERMISSION)
+	}
+}
@@ -0,0 +1,107 @@
+package xenstoreclient
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeDirectory answers directory requests for a node with many children,
+// refusing XS_DIRECTORY with E2BIG and sending XS_DIRECTORY_PART replies of
+// at most partSize names. change is called before each part is sent.
+type fakeDirectory struct {
+	children []string
+	gen      int
+	partSize int
+	change   func(d *fakeDirectory, offset int)
+}
+
+func (d *fakeDirectory) reply(req *Packet) *Packet {
+	resp := &Packet{OpCode: req.OpCode, Req: req.Req, TxID: req.TxID}
+	args := strings.Split(string(req.Value), "\x00")
+	switch req.OpCode {
+	case XS_DIRECTORY:
+		resp.OpCode, resp.Value = XS_ERROR, []byte("E2BIG\x00")
+	case XS_DIRECTORY_PART:
+		offset, _ := strconv.Atoi(args[1])
+		if d.change != nil {
+			d.change(d, offset)
+		}
+		all := ""
+		for _, child := range d.children {
+			all += child + "\x00"
+		}
+		part := all[offset:]
+		last := true
+		if len(part) > d.partSize {
+			part = part[:strings.LastIndexByte(part[:d.partSize], 0)+1]
+			last = false
+		}
+		value := strconv.Itoa(d.gen) + "\x00" + part
+		if last {
+			value += "\x00"
+		}
+		resp.Value = []byte(value)
+	default:
+		resp.OpCode, resp.Value = XS_ERROR, []byte("ENOSYS\x00")
+	}
+	resp.Length = uint32(len(resp.Value))
+	return resp
+}
+
+func (d *fakeDirectory) serve(conn net.Conn) {
+	for {
+		req, err := ReadRawPacket(conn)
+		if err != nil {
+			return
+		}
+		if err := d.reply(req).Write(conn); err != nil {
+			return
+		}
+	}
+}
+
+func names(n int) []string {
+	var children []string
+	for i := 0; i < n; i++ {
+		children = append(children, fmt.Sprintf("child-%03d", i))
+	}
+	return children
+}
+
+func TestListPart(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		d        *fakeDirectory
+		expected []string
+	}{
+		{"one part", &fakeDirectory{children: names(3), partSize: 1000}, names(3)},
+		{"many parts", &fakeDirectory{children: names(100), partSize: 64}, names(100)},
+		{"empty", &fakeDirectory{partSize: 64}, []string{}},
+		{"changed while listing", &fakeDirectory{
+			children: names(20),
+			partSize: 64,
+			change: func(d *fakeDirectory, offset int) {
+				if offset != 0 && d.gen == 0 {
+					d.children = names(30)
+					d.gen++
+				}
+			},
+		}, names(30)},
+	} {
+		client, server := net.Pipe()
+		go c.d.serve(server)
+		xs, _ := newXenstore(0, client)
+		children, err := xs.List("/local/domain/1/data")
+		if err != nil {
+			t.Errorf("%s: List error: %v", c.name, err)
+		} else if !reflect.DeepEqual(children, c.expected) {
+			t.Errorf("%s: List = %q, expected %q", c.name, children, c.expected)
+		}
+		xs.Close()
+		server.Close()
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -49,6 +50,7 @@ type Operation uint32
 
 const (
 	XS_DEBUG                Operation = 0
+	XS_CONTROL              Operation = 0
 	XS_DIRECTORY            Operation = 1
 	XS_READ                 Operation = 2
 	XS_GET_PERMS            Operation = 3
@@ -68,9 +70,47 @@ const (
 	XS_IS_DOMAIN_INTRODUCED Operation = 17
 	XS_RESUME               Operation = 18
 	XS_SET_TARGET           Operation = 19
+	XS_DIRECTORY_PART       Operation = 20
+	XS_RESET_WATCHES        Operation = 21
 	XS_RESTRICT             Operation = 128
 )
 
+var opNames = map[Operation]string{
+	XS_CONTROL:              "CONTROL",
+	XS_DIRECTORY:            "DIRECTORY",
+	XS_READ:                 "READ",
+	XS_GET_PERMS:            "GET_PERMS",
+	XS_WATCH:                "WATCH",
+	XS_UNWATCH:              "UNWATCH",
+	XS_TRANSACTION_START:    "TRANSACTION_START",
+	XS_TRANSACTION_END:      "TRANSACTION_END",
+	XS_INTRODUCE:            "INTRODUCE",
+	XS_RELEASE:              "RELEASE",
+	XS_GET_DOMAIN_PATH:      "GET_DOMAIN_PATH",
+	XS_WRITE:                "WRITE",
+	XS_MKDIR:                "MKDIR",
+	XS_RM:                   "RM",
+	XS_SET_PERMS:            "SET_PERMS",
+	XS_WATCH_EVENT:          "WATCH_EVENT",
+	XS_ERROR:                "ERROR",
+	XS_IS_DOMAIN_INTRODUCED: "IS_DOMAIN_INTRODUCED",
+	XS_RESUME:               "RESUME",
+	XS_SET_TARGET:           "SET_TARGET",
+	XS_DIRECTORY_PART:       "DIRECTORY_PART",
+	XS_RESET_WATCHES:        "RESET_WATCHES",
+	XS_RESTRICT:             "RESTRICT",
+}
+
+func (op Operation) String() string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return "OP_" + strconv.FormatUint(uint64(op), 10)
+}
+
+// XENSTORE_PAYLOAD_MAX is the largest Value a Packet may carry.
+const XENSTORE_PAYLOAD_MAX = 4096
+
 type Packet struct {
 	OpCode Operation
 	Req    uint32
@@ -103,9 +143,21 @@ type XenStoreClient interface {
 	Watch(path []string) (chan Event, error)
 	StopWatch() error
 	GetDomainPath(domid string) (string, error)
+	TransactionStart() (uint32, error)
+	TransactionEnd(commit bool) error
 }
 
 func ReadPacket(r io.Reader) (packet *Packet, err error) {
+	packet, err = ReadRawPacket(r)
+	if err == nil && packet.OpCode == XS_ERROR {
+		return nil, errors.New(strings.Split(string(packet.Value), "\x00")[0])
+	}
+	return packet, err
+}
+
+// ReadRawPacket reads a packet like ReadPacket, but returns XS_ERROR replies
+// as they are rather than as an error.
+func ReadRawPacket(r io.Reader) (packet *Packet, err error) {
 
 	packet = &Packet{}
 
@@ -132,9 +184,6 @@ func ReadPacket(r io.Reader) (packet *Packet, err error) {
 		if err != nil {
 			return nil, err
 		}
-		if packet.OpCode == XS_ERROR {
-			return nil, errors.New(strings.Split(string(packet.Value), "\x00")[0])
-		}
 	}
 
 	return packet, nil
@@ -170,15 +219,14 @@ func (p *Packet) Write(w io.Writer) (err error) {
 		if err != nil {
 			return err
 		}
-		err = bw.Flush()
-		if err != nil {
-			return err
-		}
 	}
-	return nil
+	return bw.Flush()
 }
 
 type XenStore struct {
+	// doMutex pairs each request with its reply when DO is used from
+	// several goroutines
+	doMutex          sync.Mutex
 	tx               uint32
 	xbFile           io.ReadWriteCloser
 	xbFileReader     *bufio.Reader
@@ -195,13 +243,22 @@ func NewXenstore(tx uint32) (XenStoreClient, error) {
 		return nil, err
 	}
 
-	xbFile, err := os.OpenFile(devPath, os.O_RDWR, 0666)
+	xbFile, err := OpenDevice(devPath)
 	if err != nil {
 		return nil, err
 	}
 	return newXenstore(tx, xbFile)
 }
 
+// OpenDevice opens a raw connection to xenstored through devPath, which is
+// either a xenbus device or a xenstored unix socket.
+func OpenDevice(devPath string) (io.ReadWriteCloser, error) {
+	if fi, err := os.Stat(devPath); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		return net.Dial("unix", devPath)
+	}
+	return os.OpenFile(devPath, os.O_RDWR, 0666)
+}
+
 func newXenstore(tx uint32, rwc io.ReadWriteCloser) (XenStoreClient, error) {
 	return &XenStore{
 		tx:               tx,
@@ -220,6 +277,9 @@ func (xs *XenStore) Close() error {
 }
 
 func (xs *XenStore) DO(req *Packet) (resp *Packet, err error) {
+	xs.doMutex.Lock()
+	defer xs.doMutex.Unlock()
+
 	err = req.Write(xs.xbFile)
 	if err != nil {
 		return nil, err
@@ -262,19 +322,69 @@ func (xs *XenStore) List(path string) ([]string, error) {
 		Value:  v,
 	}
 	resp, err := xs.DO(req)
+	if err != nil && err.Error() == "E2BIG" {
+		// too many children to fit in one reply
+		return xs.listPart(path)
+	}
 	if err != nil {
 		return []string{}, err
 	}
-	subItems := strings.Split(
-		string(bytes.Trim(resp.Value, "\x00")), "\x00")
+	value := bytes.Trim(resp.Value, "\x00")
+	if len(value) == 0 {
+		return []string{}, nil
+	}
+	subItems := strings.Split(string(value), "\x00")
 
 	return subItems, nil
 }
 
+// listPart lists the children of path a reply at a time, starting over
+// whenever the directory changes in between.
+func (xs *XenStore) listPart(path string) ([]string, error) {
+	var gen string
+	var children []byte
+	for offset := 0; ; {
+		v := []byte(path + "\x00" + strconv.Itoa(offset) + "\x00")
+		req := &Packet{
+			OpCode: XS_DIRECTORY_PART,
+			Req:    0,
+			TxID:   xs.tx,
+			Length: uint32(len(v)),
+			Value:  v,
+		}
+		resp, err := xs.DO(req)
+		if err != nil {
+			return []string{}, err
+		}
+		parts := bytes.SplitN(resp.Value, []byte{0}, 2)
+		if len(parts) != 2 {
+			return []string{}, errors.New("Invalid directory part reply")
+		}
+		if offset == 0 {
+			gen = string(parts[0])
+		} else if string(parts[0]) != gen {
+			children, offset = nil, 0
+			continue
+		}
+		children = append(children, parts[1]...)
+		offset += len(parts[1])
+		// the last part ends with an empty name
+		if len(parts[1]) <= 1 || bytes.HasSuffix(parts[1], []byte{0, 0}) {
+			break
+		}
+	}
+
+	value := bytes.Trim(children, "\x00")
+	if len(value) == 0 {
+		return []string{}, nil
+	}
+	return strings.Split(string(value), "\x00"), nil
+}
+
 func (xs *XenStore) Mkdir(path string) error {
 	v := []byte(path + "\x00")
 	req := &Packet{
-		OpCode: XS_WRITE,
+		OpCode: XS_MKDIR,
 		Req:    0,
 		TxID:   xs.tx,
 		Length: uint32(len(v)),
@@ -469,6 +579,55 @@ func (xs *XenStore) GetDomainPath(domid string) (string, error) {
 	return string(resp.Value), nil
 }
 
+// TransactionStart begins a transaction which all following requests on xs
+// are made within, until TransactionEnd is called.
+func (xs *XenStore) TransactionStart() (uint32, error) {
+	if xs.tx != 0 {
+		return 0, fmt.Errorf("Transaction %d already in progress", xs.tx)
+	}
+	v := []byte("\x00")
+	req := &Packet{
+		OpCode: XS_TRANSACTION_START,
+		Req:    0,
+		TxID:   0,
+		Length: uint32(len(v)),
+		Value:  v,
+	}
+	resp, err := xs.DO(req)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := strconv.ParseUint(strings.TrimRight(string(resp.Value), "\x00"), 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	xs.tx = uint32(tx)
+	return xs.tx, nil
+}
+
+// TransactionEnd commits or aborts the current transaction. A commit which
+// conflicts with another change fails with EAGAIN, after which the whole
+// transaction should be retried.
+func (xs *XenStore) TransactionEnd(commit bool) error {
+	if xs.tx == 0 {
+		return errors.New("No transaction in progress")
+	}
+	v := []byte("F\x00")
+	if commit {
+		v = []byte("T\x00")
+	}
+	req := &Packet{
+		OpCode: XS_TRANSACTION_END,
+		Req:    0,
+		TxID:   xs.tx,
+		Length: uint32(len(v)),
+		Value:  v,
+	}
+	_, err := xs.DO(req)
+	xs.tx = 0
+	return err
+}
+
 type Content struct {
 	value     string
 	keepalive bool
@@ -524,7 +683,11 @@ func (xs *CachedXenStore) Mkdir(path string) error {
 }
 
 func (xs *CachedXenStore) Rm(path string) error {
-	return xs.xs.Rm(path)
+	err := xs.xs.Rm(path)
+	if err == nil {
+		delete(xs.writeCache, path)
+	}
+	return err
 }
 
 func (xs *CachedXenStore) GetPermission(path string) ([]Permission, error) {
@@ -547,6 +710,14 @@ func (xs *CachedXenStore) GetDomainPath(domid string) (string, error) {
 	return xs.xs.GetDomainPath(domid)
 }
 
+func (xs *CachedXenStore) TransactionStart() (uint32, error) {
+	return xs.xs.TransactionStart()
+}
+
+func (xs *CachedXenStore) TransactionEnd(commit bool) error {
+	return xs.xs.TransactionEnd(commit)
+}
+
 func (xs *CachedXenStore) Clear() {
 	xs.writeCache = make(map[string]Content, 0)
 }
@@ -568,7 +739,12 @@ func (xs *CachedXenStore) InvalidCacheFlush() error {
 	return nil
 }
 
+// getDevPath returns $XENSTORED_PATH when set, which may name a xenstored
+// unix socket, and otherwise the first xenbus device found.
 func getDevPath() (devPath string, err error) {
+	if devPath = os.Getenv("XENSTORED_PATH"); devPath != "" {
+		return devPath, nil
+	}
 	devPaths := []string{
 		"/proc/xen/xenbus",
 		"/dev/xen/xenbus",